@@ -10,16 +10,21 @@ import (
 	"time"
 
 	"github.com/tus/tusd/v2/pkg/handler"
-	"github.com/tus/tusd/v2/pkg/memorylocker"
-	"github.com/tus/tusd/v2/pkg/s3store"
+	"github.com/tus/tusd/v2/pkg/prometheuscollector"
 	"sharemk/internal/config"
+	"sharemk/internal/downloads"
 	"sharemk/internal/expiry"
 	"sharemk/internal/hooks"
+	"sharemk/internal/locker"
 	"sharemk/internal/mcpserver"
+	"sharemk/internal/metrics"
 	"sharemk/internal/openapi"
 	"sharemk/internal/ratelimit"
-	"sharemk/internal/s3client"
+	"sharemk/internal/scan"
 	"sharemk/internal/server"
+	"sharemk/internal/storage"
+	"sharemk/internal/tracing"
+	"sharemk/internal/webhook"
 )
 
 // version is set at build time via -ldflags "-X main.version=v1.2.3".
@@ -32,50 +37,81 @@ func main() {
 	setupLogger(cfg.LogLevel)
 	slog.Info("starting share.mk", "version", version)
 
-	// 2. Build S3 client.
-	s3Client, err := s3client.New(cfg)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg, version)
 	if err != nil {
-		slog.Error("failed to create S3 client", "error", err)
+		slog.Error("failed to set up tracing", "error", err)
 		os.Exit(1)
 	}
 
-	// 3. Configure S3 store.
-	store := s3store.New(cfg.S3Bucket, s3Client)
-	store.ObjectPrefix = cfg.S3ObjectPrefix
+	// 2. Build the storage backend (S3 or local filesystem).
+	store, err := storage.New(cfg)
+	if err != nil {
+		slog.Error("failed to create storage backend", "backend", cfg.StorageBackend, "error", err)
+		os.Exit(1)
+	}
 
+	// 3. Configure the matching tusd store.
 	composer := handler.NewStoreComposer()
 	store.UseIn(composer)
 
-	// 4. Configure memory locker.
-	locker := memorylocker.New()
-	locker.UseIn(composer)
-
-	// 5. Set up hooks.
-	hooksHandler := hooks.New(cfg, s3Client)
+	// 4. Configure the upload locker (in memory, or shared between replicas).
+	uploadLocker, err := locker.New(cfg)
+	if err != nil {
+		slog.Error("failed to create upload locker", "locker", cfg.Locker, "error", err)
+		os.Exit(1)
+	}
+	uploadLocker.UseIn(composer)
 
-	// 6. Create tusd handler.
+	// 5. Set up webhook notifications, malware scanning and hooks.
+	notifier := webhook.New(cfg, store)
+	scanner, err := scan.New(cfg, store)
+	if err != nil {
+		slog.Error("failed to set up malware scanning", "error", err)
+		os.Exit(1)
+	}
+	hooksHandler := hooks.New(cfg, store, notifier, scanner)
+
+	// 6. Create tusd handler. Cross-origin clients must be able to read the
+	// management token and encryption key returned on upload creation, and
+	// to send the key back.
+	cors := handler.DefaultCorsConfig
+	cors.ExposeHeaders += ", Upload-Management-Token, Upload-Encryption-Key, Upload-Short-URL"
+	cors.AllowHeaders += ", X-Share-Key"
 	tusHandler, err := handler.NewHandler(handler.Config{
-		BasePath:                cfg.TUSBasePath,
-		StoreComposer:           composer,
-		MaxSize:                 cfg.TUSMaxSize,
-		RespectForwardedHeaders: true,
-		NotifyCompleteUploads:   true,
-		PreUploadCreateCallback: hooksHandler.PreCreate,
+		BasePath:                  cfg.TUSBasePath,
+		StoreComposer:             composer,
+		MaxSize:                   cfg.TUSMaxSize,
+		RespectForwardedHeaders:   true,
+		NotifyCompleteUploads:     true,
+		NotifyCreatedUploads:      true,
+		PreUploadCreateCallback:   hooksHandler.PreCreate,
+		PreFinishResponseCallback: hooksHandler.PreFinish,
+		Cors:                      &cors,
 	})
 	if err != nil {
 		slog.Error("failed to create tusd handler", "error", err)
 		os.Exit(1)
 	}
 
-	// 7. Drain CompleteUploads channel; call HandleComplete for each finished upload.
+	metrics.Register(prometheuscollector.New(tusHandler.Metrics))
+
+	// 7. Drain the CreatedUploads and CompleteUploads channels; call
+	// HandleComplete for each finished upload.
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		for {
 			select {
+			case event, ok := <-tusHandler.CreatedUploads:
+				if !ok {
+					return
+				}
+				metrics.UploadsCreated.WithLabelValues(metrics.SourceTus).Inc()
+				notifier.Notify(webhook.UploadCreated, event.Upload, time.Time{})
 			case event, ok := <-tusHandler.CompleteUploads:
 				if !ok {
 					return
 				}
+				metrics.UploadsCompleted.WithLabelValues(metrics.SourceTus).Inc()
 				go hooksHandler.HandleComplete(event)
 			case <-ctx.Done():
 				return
@@ -83,17 +119,20 @@ func main() {
 		}
 	}()
 
-	// 8. Start background expiry worker.
-	expiryWorker := expiry.New(cfg, s3Client)
+	// 8. Start background expiry worker and webhook retry queue.
+	expiryWorker := expiry.New(cfg, store, notifier)
 	go expiryWorker.Start(ctx)
+	go notifier.Start(ctx)
 
 	// 9. Build MCP server and OpenAPI handler.
-	mcpSrv := mcpserver.New(cfg, s3Client)
+	mcpSrv := mcpserver.New(cfg, store, notifier, scanner)
 	openapiHandler := openapi.Handler()
 
 	// 10. Build rate limiter and HTTP server.
 	limiter := ratelimit.New(cfg.RateLimitGlobal, cfg.RateLimitPerIP)
-	srv := server.New(cfg, tusHandler, limiter, mcpSrv.Handler(), openapiHandler)
+	metrics.Register(metrics.ActiveUploads(limiter.Active))
+	counter := downloads.New(cfg, store, uploadLocker)
+	srv := server.New(cfg, store, tusHandler, limiter, counter, notifier, scanner, mcpSrv.Handler(), openapiHandler)
 
 	httpServer := &http.Server{
 		Addr:        cfg.ServerAddr,
@@ -126,6 +165,9 @@ func main() {
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
 		slog.Error("graceful shutdown failed", "error", err)
 	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
 
 	slog.Info("server stopped")
 }
@@ -0,0 +1,141 @@
+// Package clientip works out the address of the client behind a request.
+// Behind a reverse proxy such as Caddy the connection comes from the proxy,
+// which passes the client's address on in a header. Clients can send that
+// header themselves, so it is believed only as far as it was written by
+// proxies in TRUSTED_PROXIES:
+//
+//	X-Forwarded-For: 198.51.100.7, 203.0.113.9   (from 127.0.0.1)
+//
+// is read right to left. 127.0.0.1 is a trusted proxy, so its claim that the
+// request came from 203.0.113.9 is believed; 203.0.113.9 is not a trusted
+// proxy, so it is the client, and 198.51.100.7, which anyone could have
+// written, is ignored. Loopback is trusted by default; with
+// TRUSTED_PROXIES=none the headers are ignored altogether.
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"sharemk/internal/config"
+)
+
+type Resolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+func New(cfg *config.Config) *Resolver {
+	return &Resolver{trusted: cfg.TrustedProxies, header: cfg.ClientIPHeader}
+}
+
+// Handler sets r.RemoteAddr to the client's address before passing r on,
+// so that rate limits, hooks, logs and traces all see the same client.
+// Addresses taken from a header have no port.
+func (res *Resolver) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip, ok := res.fromProxy(r); ok {
+			r.RemoteAddr = ip.String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fromProxy returns the client address recorded by trusted proxies. It
+// returns false if the request did not come through a trusted proxy.
+func (res *Resolver) fromProxy(r *http.Request) (netip.Addr, bool) {
+	peer, err := parseHop(Host(r.RemoteAddr))
+	if err != nil || !res.isTrusted(peer) {
+		return netip.Addr{}, false
+	}
+
+	var hops []string
+	switch res.header {
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case "X-Real-Ip":
+		if v := r.Header.Get("X-Real-Ip"); v != "" {
+			hops = []string{v}
+		}
+	default:
+		hops = splitList(r.Header.Values("X-Forwarded-For"))
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0 && res.isTrusted(client); i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			// A trusted proxy that hides or garbles the address before it
+			// is the last address known.
+			break
+		}
+		client = hop
+	}
+	return client, client != peer
+}
+
+func (res *Resolver) isTrusted(ip netip.Addr) bool {
+	for _, p := range res.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Host returns the host part of a request's RemoteAddr, which is a bare
+// address once Handler has replaced it.
+func Host(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// parseHop parses an address as proxies write it: bare, in brackets or with
+// a port.
+func parseHop(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	ip, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		ap, perr := netip.ParseAddrPort(s)
+		if perr != nil {
+			return netip.Addr{}, err
+		}
+		ip = ap.Addr()
+	}
+	return ip.Unmap(), nil
+}
+
+// splitList returns the entries of comma-separated header values, in order.
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		list = append(list, strings.Split(v, ",")...)
+	}
+	return list
+}
+
+// forwardedFor returns the for= parameter of each element of RFC 7239
+// Forwarded header values, in order:
+//
+//	Forwarded: for=198.51.100.7;proto=https, for="[2001:db8::1]:4711"
+//
+// Elements without one yield "", which is not an address.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, elem := range splitList(values) {
+		var hop string
+		for _, pair := range strings.Split(elem, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
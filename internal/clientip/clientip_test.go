@@ -0,0 +1,83 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"sharemk/internal/config"
+)
+
+func TestHandler(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+	tests := []struct {
+		name       string
+		trusted    []netip.Prefix
+		header     string
+		remoteAddr string
+		values     []string
+		want       string
+	}{
+		{"direct client", trusted, "X-Forwarded-For", "198.51.100.7:5000", nil, "198.51.100.7:5000"},
+		{"untrusted peer with header", trusted, "X-Forwarded-For", "198.51.100.7:5000", []string{"203.0.113.9"}, "198.51.100.7:5000"},
+		{"no trusted proxies", nil, "X-Forwarded-For", "127.0.0.1:5000", []string{"203.0.113.9"}, "127.0.0.1:5000"},
+		{"trusted peer", trusted, "X-Forwarded-For", "127.0.0.1:5000", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"ipv6 peer", trusted, "X-Forwarded-For", "[::1]:5000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"spoofed leftmost entry", trusted, "X-Forwarded-For", "127.0.0.1:5000", []string{"192.0.2.1, 203.0.113.9"}, "203.0.113.9"},
+		{"spoofed trusted entry", trusted, "X-Forwarded-For", "127.0.0.1:5000", []string{"10.0.0.1, 203.0.113.9"}, "203.0.113.9"},
+		{"proxy chain", trusted, "X-Forwarded-For", "127.0.0.1:5000", []string{"192.0.2.1, 203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{"repeated header", trusted, "X-Forwarded-For", "127.0.0.1:5000", []string{"192.0.2.1", "203.0.113.9"}, "203.0.113.9"},
+		{"garbled entry", trusted, "X-Forwarded-For", "127.0.0.1:5000", []string{"203.0.113.9, garbage"}, "127.0.0.1:5000"},
+		{"only trusted hops", trusted, "X-Forwarded-For", "127.0.0.1:5000", []string{"10.0.0.3"}, "10.0.0.3"},
+		{"forwarded", trusted, "Forwarded", "127.0.0.1:5000", []string{"for=203.0.113.9;proto=https"}, "203.0.113.9"},
+		{"forwarded quoted ipv6 with port", trusted, "Forwarded", "127.0.0.1:5000", []string{`for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{"forwarded ipv4 with port", trusted, "Forwarded", "127.0.0.1:5000", []string{`for="203.0.113.9:4711"`}, "203.0.113.9"},
+		{"forwarded spoofed leftmost", trusted, "Forwarded", "127.0.0.1:5000", []string{`for=192.0.2.1, For="[2001:db8::1]:4711";proto=https`}, "2001:db8::1"},
+		{"forwarded obfuscated", trusted, "Forwarded", "127.0.0.1:5000", []string{"for=_hidden"}, "127.0.0.1:5000"},
+		{"forwarded ignores xff", trusted, "Forwarded", "127.0.0.1:5000", nil, "127.0.0.1:5000"},
+		{"x-real-ip", trusted, "X-Real-Ip", "127.0.0.1:5000", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"x-real-ip untrusted peer", trusted, "X-Real-Ip", "198.51.100.7:5000", []string{"203.0.113.9"}, "198.51.100.7:5000"},
+		{"mapped ipv4", trusted, "X-Forwarded-For", "[::ffff:127.0.0.1]:5000", []string{"::ffff:203.0.113.9"}, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := New(&config.Config{TrustedProxies: tt.trusted, ClientIPHeader: tt.header})
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.values {
+				r.Header.Add(tt.header, v)
+			}
+			if tt.header != "X-Forwarded-For" {
+				r.Header.Set("X-Forwarded-For", "192.0.2.99")
+			}
+
+			var got string
+			res.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHost(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"198.51.100.7:5000", "198.51.100.7"},
+		{"[2001:db8::1]:5000", "2001:db8::1"},
+		{"203.0.113.9", "203.0.113.9"},
+		{"2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		if got := Host(tt.in); got != tt.want {
+			t.Errorf("Host(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Package collection groups several uploads behind one link. A collection is
+// created first; its ID and token are then sent with each tus upload in the
+// collection and collection-token metadata, or passed to the upload_file MCP
+// tool. Recipients get a listing of the files and a zip of all of them.
+//
+// A collection is stored as a small JSON record with one empty marker object
+// per member upload, all under the collection's own directory:
+//
+//	collections/3f2a…/collection.json
+//	collections/3f2a…/files/<upload ID>
+//
+// Markers are written by each upload separately, so parallel uploads never
+// race on a shared object. The record is tagged with the collection's
+// expiry and indexed like an upload; the expiry worker deletes the whole
+// directory once it passes. Members expire together with their collection.
+package collection
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/config"
+	"sharemk/internal/expiry"
+	"sharemk/internal/lifetime"
+	"sharemk/internal/manage"
+	"sharemk/internal/storage"
+)
+
+// Metadata keys a tus upload joins a collection with. The token is checked
+// when the upload is created and never stored with it. PathKey optionally
+// places the file in a folder of the collection, as in "exports/icons/a.png".
+const (
+	IDKey    = "collection"
+	TokenKey = "collection-token"
+	PathKey  = "path"
+)
+
+// Bounds on the relative path of a file in a collection.
+const (
+	maxPathLen   = 1024
+	maxPathDepth = 32
+)
+
+// recordName is the name of the collection record within its directory.
+const recordName = "collection.json"
+
+// maxNameLen bounds the display name of a collection.
+const maxNameLen = 255
+
+// ErrNotFound is returned for collections that do not exist or have
+// expired.
+var ErrNotFound = errors.New("collection not found")
+
+// ErrUnauthorized is returned when the collection does not exist or the
+// token does not match; like manage.ErrUnauthorized, the cases cannot be
+// told apart.
+var ErrUnauthorized = errors.New("invalid collection_id or collection_token")
+
+// Collection is the stored record of a collection.
+type Collection struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type Collections struct {
+	cfg    *config.Config
+	store  storage.Backend
+	index  *expiry.Index
+	policy lifetime.Policy
+}
+
+func New(cfg *config.Config, store storage.Backend) *Collections {
+	return &Collections{
+		cfg:    cfg,
+		store:  store,
+		index:  expiry.NewIndex(cfg, store),
+		policy: lifetime.Policy{Min: cfg.ExpiryMin, Max: cfg.ExpiryMax, Default: cfg.ExpiryDefault},
+	}
+}
+
+// Create stores a new collection expiring after expiresIn or at expiresAt,
+// within the same bounds that apply to uploads. Invalid input is reported
+// as a *manage.InvalidError.
+func (c *Collections) Create(ctx context.Context, name, expiresIn, expiresAt string) (Collection, error) {
+	if len(name) > maxNameLen {
+		return Collection{}, &manage.InvalidError{Err: errors.New("name must be at most 255 bytes")}
+	}
+	now := time.Now().UTC()
+	expiresTime, err := c.policy.Resolve(expiresIn, expiresAt, now)
+	if err != nil {
+		return Collection{}, &manage.InvalidError{Err: err}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Collection{}, err
+	}
+	token, err := manage.GenerateToken()
+	if err != nil {
+		return Collection{}, err
+	}
+	col := Collection{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Token:     token,
+		CreatedAt: now.Truncate(time.Second),
+		ExpiresAt: expiresTime,
+	}
+
+	key := c.recordKey(col.ID)
+	data, err := json.Marshal(col)
+	if err != nil {
+		return Collection{}, err
+	}
+	if err := c.store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "application/json"); err != nil {
+		return Collection{}, err
+	}
+	if err := c.store.SetTags(ctx, key, map[string]string{"expires-at": expiresTime.Format(time.RFC3339)}); err != nil {
+		return Collection{}, err
+	}
+	// A missing marker leaves the collection behind until it is deleted by
+	// hand; its members still expire on their own.
+	if err := c.index.Add(ctx, key, expiresTime); err != nil {
+		slog.Warn("collection: failed to index expiry", "key", key, "error", err)
+	}
+
+	slog.Info("collection: created", "collection_id", col.ID, "expires_at", expiresTime.Format(time.RFC3339))
+	return col, nil
+}
+
+// Get returns collection id.
+func (c *Collections) Get(ctx context.Context, id string) (Collection, error) {
+	if !validID(id) {
+		return Collection{}, ErrNotFound
+	}
+	body, err := c.store.Get(ctx, c.recordKey(id))
+	if errors.Is(err, storage.ErrNotFound) {
+		return Collection{}, ErrNotFound
+	}
+	if err != nil {
+		return Collection{}, err
+	}
+	defer body.Close()
+
+	var col Collection
+	if err := json.NewDecoder(body).Decode(&col); err != nil {
+		return Collection{}, err
+	}
+	// The worker may not have got to it yet.
+	if time.Now().After(col.ExpiresAt) {
+		return Collection{}, ErrNotFound
+	}
+	return col, nil
+}
+
+// MemberExpiry returns when the collection of the upload with metadata meta
+// expires. ok is false for uploads in no collection; a collection that no
+// longer exists is reported as a *manage.InvalidError.
+func (c *Collections) MemberExpiry(ctx context.Context, meta map[string]string) (t time.Time, ok bool, err error) {
+	id, ok := meta[IDKey]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	col, err := c.Get(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return time.Time{}, true, &manage.InvalidError{Err: err}
+	}
+	if err != nil {
+		return time.Time{}, true, err
+	}
+	return col.ExpiresAt, true, nil
+}
+
+// Authorize returns collection id if token is its token.
+func (c *Collections) Authorize(ctx context.Context, id, token string) (Collection, error) {
+	col, err := c.Get(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return Collection{}, ErrUnauthorized
+	}
+	if err != nil {
+		return Collection{}, err
+	}
+	if !manage.TokenMatches(col.Token, token) {
+		return Collection{}, ErrUnauthorized
+	}
+	return col, nil
+}
+
+// Add records upload uploadID as a member of collection id. The caller has
+// already authorised the upload.
+func (c *Collections) Add(ctx context.Context, id, uploadID string) error {
+	return c.store.Put(ctx, c.memberPrefix(id)+uploadID, bytes.NewReader(nil), 0, "application/octet-stream")
+}
+
+// Files returns the .info of every member of collection id in the order the
+// storage backend lists them. Members that have since been deleted or have
+// expired are left out.
+func (c *Collections) Files(ctx context.Context, id string) ([]handler.FileInfo, error) {
+	prefix := c.memberPrefix(id)
+	var ids []string
+	err := c.store.List(ctx, prefix, func(obj storage.ObjectInfo) error {
+		ids = append(ids, strings.TrimPrefix(obj.Key, prefix))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]handler.FileInfo, 0, len(ids))
+	for _, uploadID := range ids {
+		info, err := storage.ReadInfo(ctx, c.store, c.store.UploadKey(uploadID))
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+// URL returns the public URL of collection id.
+func (c *Collections) URL(id string) string {
+	return strings.TrimRight(c.cfg.PublicURL, "/") + "/c/" + id
+}
+
+func (c *Collections) recordKey(id string) string {
+	return c.cfg.CollectionPrefix + id + "/" + recordName
+}
+
+func (c *Collections) memberPrefix(id string) string {
+	return c.cfg.CollectionPrefix + id + "/files/"
+}
+
+// CleanPath checks the relative path of a file in a collection and returns
+// it with backslashes turned into slashes. Paths end up as names in zip
+// archives, so anything that could point outside the directory the archive
+// is extracted to is refused: absolute paths, drive letters, "." and ".."
+// segments, empty segments and control characters.
+func CleanPath(p string) (string, error) {
+	p = strings.ReplaceAll(p, `\`, "/")
+	switch {
+	case p == "":
+		return "", errors.New("path must not be empty")
+	case len(p) > maxPathLen:
+		return "", fmt.Errorf("path must be at most %d bytes", maxPathLen)
+	case strings.HasPrefix(p, "/") || strings.Contains(p, ":"):
+		return "", errors.New("path must be relative")
+	}
+	segments := strings.Split(p, "/")
+	if len(segments) > maxPathDepth {
+		return "", fmt.Errorf("path must be at most %d levels deep", maxPathDepth)
+	}
+	for _, seg := range segments {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("invalid path %q; it must not contain empty, . or .. segments", p)
+		}
+		if strings.ContainsFunc(seg, unicode.IsControl) {
+			return "", errors.New("path must not contain control characters")
+		}
+	}
+	return p, nil
+}
+
+// validID reports whether id has the form Create gives IDs, so that no
+// other key can be reached through it.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,77 @@
+package collection
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "report.pdf", want: "report.pdf"},
+		{in: "docs/q3/report.pdf", want: "docs/q3/report.pdf"},
+		{in: `docs\q3\report.pdf`, want: "docs/q3/report.pdf"},
+		{in: "..report.pdf", want: "..report.pdf"},
+		{in: "a/.hidden", want: "a/.hidden"},
+		{in: "ünïcode/файл.txt", want: "ünïcode/файл.txt"},
+		{in: strings.Repeat("a/", maxPathDepth-1) + "a", want: strings.Repeat("a/", maxPathDepth-1) + "a"},
+
+		{in: "", wantErr: true},
+		{in: "..", wantErr: true},
+		{in: "../etc/passwd", wantErr: true},
+		{in: "docs/../../etc/passwd", wantErr: true},
+		{in: `..\windows\system32`, wantErr: true},
+		{in: `docs\..\..\evil`, wantErr: true},
+		{in: ".", wantErr: true},
+		{in: "./report.pdf", wantErr: true},
+		{in: "docs/.", wantErr: true},
+		{in: "/etc/passwd", wantErr: true},
+		{in: `\etc\passwd`, wantErr: true},
+		{in: `\\server\share\file`, wantErr: true},
+		{in: "C:/Windows/evil.exe", wantErr: true},
+		{in: `C:\Windows\evil.exe`, wantErr: true},
+		{in: "C:evil.exe", wantErr: true},
+		{in: "docs//report.pdf", wantErr: true},
+		{in: "docs/", wantErr: true},
+		{in: "report\x00.pdf", wantErr: true},
+		{in: "docs/\x00/report.pdf", wantErr: true},
+		{in: "report\n.pdf", wantErr: true},
+		{in: "report\x7f.pdf", wantErr: true},
+		{in: strings.Repeat("a", maxPathLen+1), wantErr: true},
+		{in: strings.Repeat("a/", maxPathDepth) + "a", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := CleanPath(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("CleanPath(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("CleanPath(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"0123456789abcdef0123456789abcdef", true},
+		{"0123456789ABCDEF0123456789ABCDEF", true},
+		{"0123456789abcdef", false},
+		{"0123456789abcdef0123456789abcdeg", false},
+		{"../../uploads/0123456789abcdef01", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validID(tt.id); got != tt.want {
+			t.Errorf("validID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -2,42 +2,198 @@ package config
 
 import (
 	"fmt"
+	"net/http"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
+
+	"sharemk/internal/lifetime"
 )
 
 type Config struct {
+	StorageBackend  string
+	LocalStorageDir string
 	S3Bucket        string
 	S3Region        string
 	S3Endpoint      string
 	S3AccessKey     string
 	S3SecretKey     string
 	S3ObjectPrefix  string
+	S3SSEC          string
+	S3PresignGet    bool
+	S3PresignTTL    time.Duration
 	TUSBasePath     string
 	TUSMaxSize      int64
 	ServerAddr      string
 	PublicURL       string
 	RateLimitGlobal int
 	RateLimitPerIP  int
+	TrustedProxies  []netip.Prefix
+	ClientIPHeader  string
 	LogLevel        string
+	MetricsToken    string
+	OTLPEndpoint    string
+
+	ReadyWriteProbe bool
+	ReadyCacheTTL   time.Duration
+
+	WebhookURLs        []string
+	WebhookSecret      string
+	WebhookPerUpload   bool
+	WebhookQueuePrefix string
+
+	ContentTypesAllow []string
+	ContentTypesDeny  []string
+
+	ClamdAddr            string
+	ScanMaxSize          int64
+	ScanAction           string
+	ScanQuarantinePrefix string
+	ScanFailOpen         bool
+
+	Locker       string
+	LockerDir    string
+	LockerPrefix string
+
+	PasswordMaxAttempts int
+
+	CollectionPrefix string
+
+	ShortLinkPrefix string
+	ShortLinkSlugs  bool
+
+	ExpiryMin               time.Duration
+	ExpiryMax               time.Duration
+	ExpiryDefault           time.Duration
+	ExpiryIndexPrefix       string
+	ExpiryReconcileInterval time.Duration
 }
 
 func Load() *Config {
-	return &Config{
-		S3Bucket:        mustEnv("S3_BUCKET"),
-		S3Region:        mustEnv("S3_REGION"),
-		S3Endpoint:      mustEnv("S3_ENDPOINT"),
-		S3AccessKey:     mustEnv("S3_ACCESS_KEY"),
-		S3SecretKey:     mustEnv("S3_SECRET_KEY"),
+	cfg := &Config{
+		StorageBackend:  getEnvOrDefault("STORAGE_BACKEND", "s3"),
+		LocalStorageDir: getEnvOrDefault("LOCAL_STORAGE_DIR", "./data"),
 		S3ObjectPrefix:  getEnvOrDefault("S3_OBJECT_PREFIX", "uploads/"),
+		S3SSEC:          getEnvOrDefault("S3_SSE_C", "off"),
+		S3PresignGet:    mustEnvBool("S3_PRESIGN_DOWNLOADS", false),
+		S3PresignTTL:    mustEnvDuration("S3_PRESIGN_TTL", 5*time.Minute),
 		TUSBasePath:     getEnvOrDefault("TUS_BASE_PATH", "/files/"),
 		TUSMaxSize:      mustEnvInt64("TUS_MAX_SIZE", 10737418240),
 		ServerAddr:      getEnvOrDefault("SERVER_ADDR", ":8080"),
 		PublicURL:       getEnvOrDefault("PUBLIC_URL", "http://localhost:8080"),
 		RateLimitGlobal: mustEnvInt("RATE_LIMIT_GLOBAL", 50),
 		RateLimitPerIP:  mustEnvInt("RATE_LIMIT_PER_IP", 5),
+		TrustedProxies:  mustEnvPrefixes("TRUSTED_PROXIES", "127.0.0.1/32,::1/128"),
+		ClientIPHeader:  http.CanonicalHeaderKey(getEnvOrDefault("CLIENT_IP_HEADER", "X-Forwarded-For")),
 		LogLevel:        getEnvOrDefault("LOG_LEVEL", "info"),
+		MetricsToken:    os.Getenv("METRICS_TOKEN"),
+		OTLPEndpoint:    getEnvOrDefault("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+
+		ReadyWriteProbe: mustEnvBool("READYZ_WRITE_PROBE", false),
+		ReadyCacheTTL:   mustEnvDuration("READYZ_CACHE_TTL", 10*time.Second),
+
+		WebhookURLs:        envList("WEBHOOK_URLS"),
+		WebhookSecret:      os.Getenv("WEBHOOK_SECRET"),
+		WebhookPerUpload:   mustEnvBool("WEBHOOK_PER_UPLOAD", false),
+		WebhookQueuePrefix: getEnvOrDefault("WEBHOOK_QUEUE_PREFIX", "webhook-queue/"),
+
+		ContentTypesAllow: envList("CONTENT_TYPES_ALLOW"),
+		ContentTypesDeny:  envList("CONTENT_TYPES_DENY"),
+
+		ClamdAddr:            os.Getenv("CLAMD_ADDR"),
+		ScanMaxSize:          mustEnvInt64("SCAN_MAX_SIZE", 25<<20),
+		ScanAction:           getEnvOrDefault("SCAN_ACTION", "quarantine"),
+		ScanQuarantinePrefix: getEnvOrDefault("SCAN_QUARANTINE_PREFIX", "quarantine/"),
+		ScanFailOpen:         mustEnvBool("SCAN_FAIL_OPEN", false),
+
+		Locker:       getEnvOrDefault("LOCKER", "memory"),
+		LockerPrefix: getEnvOrDefault("LOCKER_PREFIX", "locks/"),
+
+		PasswordMaxAttempts: mustEnvInt("PASSWORD_MAX_ATTEMPTS", 5),
+
+		CollectionPrefix: getEnvOrDefault("COLLECTION_PREFIX", "collections/"),
+
+		ShortLinkPrefix: getEnvOrDefault("SHORT_LINK_PREFIX", "short/"),
+		ShortLinkSlugs:  mustEnvBool("SHORT_LINK_SLUGS", false),
+
+		ExpiryMin:               mustEnvLifetime("EXPIRY_MIN", 5*time.Minute),
+		ExpiryMax:               mustEnvLifetime("EXPIRY_MAX", 30*24*time.Hour),
+		ExpiryDefault:           mustEnvLifetime("EXPIRY_DEFAULT", 24*time.Hour),
+		ExpiryIndexPrefix:       getEnvOrDefault("EXPIRY_INDEX_PREFIX", "expiry-index/"),
+		ExpiryReconcileInterval: mustEnvDuration("EXPIRY_RECONCILE_INTERVAL", 24*time.Hour),
+	}
+
+	switch cfg.StorageBackend {
+	case "s3":
+		// S3 credentials are only required when S3 is the storage backend.
+		cfg.S3Bucket = mustEnv("S3_BUCKET")
+		cfg.S3Region = mustEnv("S3_REGION")
+		cfg.S3Endpoint = mustEnv("S3_ENDPOINT")
+		cfg.S3AccessKey = mustEnv("S3_ACCESS_KEY")
+		cfg.S3SecretKey = mustEnv("S3_SECRET_KEY")
+	case "local":
+		if cfg.S3SSEC != "off" {
+			panic("S3_SSE_C requires STORAGE_BACKEND=s3")
+		}
+		if cfg.S3PresignGet {
+			panic("S3_PRESIGN_DOWNLOADS requires STORAGE_BACKEND=s3")
+		}
+	default:
+		panic(fmt.Sprintf("invalid value for STORAGE_BACKEND: %q (must be s3 or local)", cfg.StorageBackend))
+	}
+
+	switch cfg.S3SSEC {
+	case "off", "optional", "always":
+	default:
+		panic(fmt.Sprintf("invalid value for S3_SSE_C: %q (must be off, optional or always)", cfg.S3SSEC))
+	}
+
+	// SigV4 presigned URLs are valid for at most a week.
+	if cfg.S3PresignTTL < time.Second || cfg.S3PresignTTL > 7*24*time.Hour {
+		panic("S3_PRESIGN_TTL must be between 1s and 168h")
+	}
+
+	// Lock files default to a directory next to the uploads, so replicas
+	// sharing the storage volume share the locks too.
+	cfg.LockerDir = getEnvOrDefault("LOCKER_DIR", filepath.Join(cfg.LocalStorageDir, "locks"))
+
+	switch cfg.Locker {
+	case "memory", "file":
+	case "s3":
+		if cfg.StorageBackend != "s3" {
+			panic("LOCKER=s3 requires STORAGE_BACKEND=s3")
+		}
+	default:
+		panic(fmt.Sprintf("invalid value for LOCKER: %q (must be memory, file or s3)", cfg.Locker))
+	}
+
+	if len(cfg.WebhookURLs) > 0 && cfg.WebhookSecret == "" {
+		panic("WEBHOOK_SECRET is required when WEBHOOK_URLS is set")
+	}
+
+	switch cfg.ClientIPHeader {
+	case "X-Forwarded-For", "Forwarded", "X-Real-Ip":
+	default:
+		panic(fmt.Sprintf("invalid value for CLIENT_IP_HEADER: %q (must be X-Forwarded-For, Forwarded or X-Real-IP)", os.Getenv("CLIENT_IP_HEADER")))
+	}
+
+	switch cfg.ScanAction {
+	case "quarantine", "delete":
+	default:
+		panic(fmt.Sprintf("invalid value for SCAN_ACTION: %q (must be quarantine or delete)", cfg.ScanAction))
+	}
+
+	if cfg.ExpiryMin > cfg.ExpiryMax {
+		panic("EXPIRY_MIN must not be greater than EXPIRY_MAX")
 	}
+	if cfg.ExpiryDefault < cfg.ExpiryMin || cfg.ExpiryDefault > cfg.ExpiryMax {
+		panic("EXPIRY_DEFAULT must be between EXPIRY_MIN and EXPIRY_MAX")
+	}
+
+	return cfg
 }
 
 func mustEnv(key string) string {
@@ -55,6 +211,17 @@ func getEnvOrDefault(key, def string) string {
 	return def
 }
 
+// envList reads a comma-separated list, dropping empty entries.
+func envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func mustEnvInt64(key string, def int64) int64 {
 	v := os.Getenv(key)
 	if v == "" {
@@ -78,3 +245,66 @@ func mustEnvInt(key string, def int) int {
 	}
 	return n
 }
+
+func mustEnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		panic(fmt.Sprintf("invalid value for %s: %v", key, err))
+	}
+	return b
+}
+
+func mustEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		panic(fmt.Sprintf("invalid value for %s: %v", key, err))
+	}
+	return d
+}
+
+// mustEnvLifetime reads an upload lifetime, which unlike mustEnvDuration also
+// accepts day and ISO-8601 units such as 7d or P2W.
+func mustEnvLifetime(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := lifetime.ParseDuration(v)
+	if err != nil {
+		panic(fmt.Sprintf("invalid value for %s: %v", key, err))
+	}
+	return d
+}
+
+// mustEnvPrefixes reads a comma-separated list of CIDRs or IPs, falling back
+// to def when unset. "none" stands for an empty list.
+func mustEnvPrefixes(key, def string) []netip.Prefix {
+	v := getEnvOrDefault(key, def)
+	if strings.EqualFold(v, "none") {
+		return nil
+	}
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(v, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			panic(fmt.Sprintf("invalid value for %s: %v", key, err))
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes
+}
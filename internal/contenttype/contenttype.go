@@ -0,0 +1,189 @@
+// Package contenttype detects the type of an upload from its first bytes and
+// decides which types may be stored and which may be rendered inline. It is
+// shared by the tus hooks, the MCP upload tool and the download handler.
+//
+// The type an uploader declares in the filetype or content-type metadata is
+// never trusted on its own: a file declared as text/plain can still be an
+// HTML page, and serving that inline would run its scripts on this origin.
+package contenttype
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SniffLen is the number of leading bytes Detect looks at.
+const SniffLen = 512
+
+// MetaKey is the metadata key holding the detected type.
+const MetaKey = "detected-type"
+
+// Octet is the type of data that could not be identified.
+const Octet = "application/octet-stream"
+
+// safeType is served instead of an active type. Active types are all text,
+// so recipients still see the content, but browsers do not execute it.
+const safeType = "text/plain; charset=utf-8"
+
+// activeTypes can run script when a browser renders them. So can any XML
+// type (see Active).
+var activeTypes = map[string]bool{
+	"text/html":                     true,
+	"application/xhtml+xml":         true,
+	"image/svg+xml":                 true,
+	"text/xml":                      true,
+	"application/xml":               true,
+	"text/xsl":                      true,
+	"application/xslt+xml":          true,
+	"text/javascript":               true,
+	"text/ecmascript":               true,
+	"application/javascript":        true,
+	"application/x-javascript":      true,
+	"application/ecmascript":        true,
+	"text/x-component":              true,
+	"application/x-shockwave-flash": true,
+}
+
+// inlineTypes may be rendered inline besides video/* and audio/*: browsers
+// display them without running anything on this origin. Every other type is
+// sent as an attachment.
+var inlineTypes = map[string]bool{
+	"image/png":                true,
+	"image/apng":               true,
+	"image/jpeg":               true,
+	"image/gif":                true,
+	"image/webp":               true,
+	"image/avif":               true,
+	"image/bmp":                true,
+	"image/x-icon":             true,
+	"image/vnd.microsoft.icon": true,
+	"application/pdf":          true,
+	"text/plain":               true,
+}
+
+// signatures adds executables, which net/http does not sniff, so that they
+// can be denied.
+var signatures = []struct {
+	prefix []byte
+	typ    string
+}{
+	{[]byte("MZ"), "application/vnd.microsoft.portable-executable"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+}
+
+// Detect returns the media type of a file whose first bytes are head. Plain
+// text is refined by the file name's extension, so that scripts and markup
+// without a recognisable header are still caught; binary data is not, since
+// the name cannot make it any safer to serve.
+func Detect(head []byte, filename string) string {
+	for _, s := range signatures {
+		if bytes.HasPrefix(head, s.prefix) {
+			return s.typ
+		}
+	}
+
+	typ := base(http.DetectContentType(head))
+	switch typ {
+	case "text/plain", "text/xml":
+		if bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+			return "image/svg+xml"
+		}
+		if typ == "text/plain" {
+			if ext := base(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))); ext != "" {
+				return ext
+			}
+		}
+	}
+	return typ
+}
+
+// Active reports whether browsers may execute content of type typ. XML
+// types such as application/vnd.foo+xml can carry XHTML or XSLT, so all of
+// them count.
+func Active(typ string) bool {
+	t := base(typ)
+	return activeTypes[t] || strings.HasSuffix(t, "+xml")
+}
+
+// Inline reports whether content of type typ may be rendered inline.
+func Inline(typ string) bool {
+	t := base(typ)
+	return inlineTypes[t] || strings.HasPrefix(t, "video/") || strings.HasPrefix(t, "audio/")
+}
+
+// Serve returns the Content-Type to send for an upload with metadata meta,
+// and whether it may be shown inline. Only the types Inline allows are;
+// active content is sent as an attachment with a plain text type.
+func Serve(meta map[string]string) (contentType string, inline bool) {
+	detected := meta[MetaKey]
+	declared := Declared(meta)
+	if Active(declared) || Active(detected) {
+		return safeType, false
+	}
+
+	typ := Octet
+	switch {
+	case base(declared) != "":
+		typ = declared
+	case detected != "":
+		typ = detected
+	}
+	return typ, Inline(typ)
+}
+
+// Declared returns the type the uploader declared, preferring tusd's
+// filetype key over content-type.
+func Declared(meta map[string]string) string {
+	if t := meta["filetype"]; t != "" {
+		return t
+	}
+	return meta["content-type"]
+}
+
+// Policy restricts which types may be uploaded. Entries are media types
+// such as "application/pdf" or wildcards such as "image/*".
+type Policy struct {
+	// Allow, if not empty, lists the only types that are accepted.
+	Allow []string
+	// Deny lists types that are rejected, even if allowed.
+	Deny []string
+}
+
+// Check returns an error if typ may not be uploaded.
+func (p Policy) Check(typ string) error {
+	t := base(typ)
+	if t == "" {
+		t = Octet
+	}
+	if matchAny(p.Deny, t) || (len(p.Allow) > 0 && !matchAny(p.Allow, t)) {
+		return fmt.Errorf("file type %s is not allowed on this server", t)
+	}
+	return nil
+}
+
+func matchAny(patterns []string, t string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == t || p == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "/*"); ok && strings.HasPrefix(t, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// base returns the lower-case media type of typ without parameters, or ""
+// if typ is malformed.
+func base(typ string) string {
+	t, _, err := mime.ParseMediaType(typ)
+	if err != nil {
+		return ""
+	}
+	return t
+}
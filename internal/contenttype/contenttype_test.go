@@ -0,0 +1,101 @@
+package contenttype
+
+import "testing"
+
+func TestActive(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want bool
+	}{
+		{"text/html", true},
+		{"text/html; charset=utf-8", true},
+		{"TEXT/HTML", true},
+		{"application/xhtml+xml", true},
+		{"image/svg+xml", true},
+		{"image/svg+xml; charset=utf-8", true},
+		{"application/vnd.foo+xml", true},
+		{"text/xml", true},
+		{"application/xml", true},
+		{"text/xsl", true},
+		{"application/xslt+xml", true},
+		{"text/javascript", true},
+		{"application/javascript", true},
+		{"application/x-shockwave-flash", true},
+		{"text/plain", false},
+		{"image/png", false},
+		{"application/pdf", false},
+		{"application/json", false},
+		{"", false},
+		{"not a type", false},
+	}
+	for _, tt := range tests {
+		if got := Active(tt.typ); got != tt.want {
+			t.Errorf("Active(%q) = %v, want %v", tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want bool
+	}{
+		{"image/png", true},
+		{"image/jpeg", true},
+		{"image/gif", true},
+		{"image/webp", true},
+		{"image/avif", true},
+		{"video/mp4", true},
+		{"video/webm", true},
+		{"audio/mpeg", true},
+		{"application/pdf", true},
+		{"text/plain", true},
+		{"text/plain; charset=utf-8", true},
+		{"image/svg+xml", false},
+		{"text/html", false},
+		{"text/xsl", false},
+		{"text/csv", false},
+		{"multipart/x-mixed-replace", false},
+		{"application/json", false},
+		{"application/zip", false},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := Inline(tt.typ); got != tt.want {
+			t.Errorf("Inline(%q) = %v, want %v", tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	tests := []struct {
+		name        string
+		meta        map[string]string
+		contentType string
+		inline      bool
+	}{
+		{"declared image", map[string]string{"filetype": "image/png"}, "image/png", true},
+		{"declared video", map[string]string{"filetype": "video/mp4", MetaKey: "video/mp4"}, "video/mp4", true},
+		{"content-type key", map[string]string{"content-type": "application/pdf"}, "application/pdf", true},
+		{"detected only", map[string]string{MetaKey: "text/plain"}, "text/plain", true},
+		{"nothing known", map[string]string{}, Octet, false},
+		{"declared html", map[string]string{"filetype": "text/html"}, safeType, false},
+		{"declared svg with parameters", map[string]string{"filetype": "image/svg+xml;charset=utf-8"}, safeType, false},
+		{"declared xml suffix", map[string]string{"filetype": "application/vnd.foo+xml"}, safeType, false},
+		{"declared xsl", map[string]string{"filetype": "text/xsl"}, safeType, false},
+		{"html declared as text", map[string]string{"filetype": "text/plain", MetaKey: "text/html"}, safeType, false},
+		{"svg declared as image", map[string]string{"filetype": "image/png", MetaKey: "image/svg+xml"}, safeType, false},
+		{"mixed replace", map[string]string{"filetype": "multipart/x-mixed-replace"}, "multipart/x-mixed-replace", false},
+		{"archive", map[string]string{"filetype": "application/zip"}, "application/zip", false},
+		{"malformed declared", map[string]string{"filetype": ";;", MetaKey: "image/gif"}, "image/gif", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, inline := Serve(tt.meta)
+			if contentType != tt.contentType || inline != tt.inline {
+				t.Errorf("Serve(%v) = %q, %v; want %q, %v", tt.meta, contentType, inline, tt.contentType, tt.inline)
+			}
+		})
+	}
+}
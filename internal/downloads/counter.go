@@ -0,0 +1,201 @@
+// Package downloads enforces the optional per-upload download limit set via
+// the max-downloads metadata key.
+package downloads
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/config"
+	"sharemk/internal/expiry"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+)
+
+// ErrExhausted is returned by Acquire once an upload's download limit has
+// been used up.
+var ErrExhausted = errors.New("downloads: download limit reached")
+
+// lockTimeout bounds how long a download waits for another replica to
+// finish updating the same count.
+const lockTimeout = 10 * time.Second
+
+// Counter tracks downloads of uploads that carry a max-downloads limit.
+// Counts are persisted next to the upload ("<key>.downloads") so they survive
+// restarts, and the read-increment-write is done under a lock from the
+// configured upload locker, so concurrent requests cannot both claim the last
+// download even when they reach different replicas.
+type Counter struct {
+	store  storage.Backend
+	locker handler.Locker
+	index  *expiry.Index
+	links  *shortlink.Links
+}
+
+func New(cfg *config.Config, store storage.Backend, locker handler.Locker) *Counter {
+	return &Counter{
+		store:  store,
+		locker: locker,
+		index:  expiry.NewIndex(cfg, store),
+		links:  shortlink.New(cfg, store),
+	}
+}
+
+// Acquire reserves one download of the upload with the given tus ID and
+// info. Uploads without a limit, and uploads that are still in progress, are
+// let through untouched so tusd can answer them as usual. last reports
+// whether this was the final download allowed; the caller should Burn the
+// upload once it has been served.
+func (c *Counter) Acquire(ctx context.Context, id string, info handler.FileInfo) (last bool, err error) {
+	key := c.store.UploadKey(id)
+
+	limit, limited := Limit(info.MetaData)
+	if !limited {
+		return false, nil
+	}
+
+	// Only count downloads of finished uploads; anything else is answered
+	// by tusd without serving the file.
+	obj, err := c.store.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && (info.SizeIsDeferred || obj.Size != info.Size)) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	unlock, err := c.lock(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	used, err := c.used(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if used >= limit {
+		return false, ErrExhausted
+	}
+
+	if err := c.save(ctx, key, used+1); err != nil {
+		return false, err
+	}
+	return used+1 == limit, nil
+}
+
+// Release gives back a download reserved by Acquire that could not be
+// served in full, such as one the client broke off. It does nothing once
+// the upload has been burnt.
+func (c *Counter) Release(ctx context.Context, id string, info handler.FileInfo) error {
+	if _, limited := Limit(info.MetaData); !limited {
+		return nil
+	}
+	key := c.store.UploadKey(id)
+
+	unlock, err := c.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := c.store.Stat(ctx, key); errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	used, err := c.used(ctx, key)
+	if err != nil || used == 0 {
+		return err
+	}
+	return c.save(ctx, key, used-1)
+}
+
+// Burn deletes an upload whose final download has been served, along with
+// its expiry index marker and short link. It holds the count lock so that
+// a Release cannot recreate the count of the deleted upload.
+func (c *Counter) Burn(ctx context.Context, id string, info handler.FileInfo) error {
+	key := c.store.UploadKey(id)
+
+	unlock, err := c.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tags, err := c.store.GetTags(ctx, key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if err := c.store.Delete(ctx, storage.UploadObjects(key)...); err != nil {
+		return err
+	}
+	if t, err := time.Parse(time.RFC3339, tags["expires-at"]); err == nil {
+		if err := c.index.Remove(ctx, key, t); err != nil {
+			slog.Warn("downloads: failed to remove expiry marker", "upload_id", id, "error", err)
+		}
+	}
+	if err := c.links.Delete(ctx, info.MetaData[shortlink.MetaKey]); err != nil {
+		slog.Warn("downloads: failed to delete short link", "upload_id", id, "error", err)
+	}
+	return nil
+}
+
+// used returns the number of downloads recorded for the upload at key.
+func (c *Counter) used(ctx context.Context, key string) (int, error) {
+	body, err := c.store.Get(ctx, key+".downloads")
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// save records used downloads of the upload at key.
+func (c *Counter) save(ctx context.Context, key string, used int) error {
+	b := []byte(strconv.Itoa(used))
+	return c.store.Put(ctx, key+".downloads", bytes.NewReader(b), int64(len(b)), "text/plain")
+}
+
+// lock takes the download-count lock of the upload whose data object is
+// stored at key and returns its release function. The lock is named after
+// the data object rather than the tus ID, since on S3 several IDs reach the
+// same upload. It is separate from the one tusd holds while serving the
+// upload, and its holder never lets go early: a count update is short.
+func (c *Counter) lock(ctx context.Context, key string) (func(), error) {
+	l, err := c.locker.NewLock(path.Base(key) + ".downloads")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	if err := l.Lock(ctx, func() {}); err != nil {
+		return nil, err
+	}
+	return func() { l.Unlock() }, nil
+}
+
+// Limit returns the max-downloads value stored in upload metadata.
+func Limit(meta map[string]string) (n int, ok bool) {
+	n, err := strconv.Atoi(meta["max-downloads"])
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
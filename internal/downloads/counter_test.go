@@ -0,0 +1,194 @@
+package downloads
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/memorylocker"
+	"sharemk/internal/config"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+)
+
+// s3Keys is a local backend that maps tus IDs to keys the way the S3
+// backend does, ignoring everything after "+". Reading a download count
+// takes a while, as it would over the network, so that requests not
+// serialised by the lock overlap.
+type s3Keys struct {
+	*storage.Local
+}
+
+func (b s3Keys) UploadKey(id string) string {
+	id, _, _ = strings.Cut(id, "+")
+	return b.Local.UploadKey(id)
+}
+
+func (b s3Keys) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := b.Local.Get(ctx, key)
+	if strings.HasSuffix(key, ".downloads") {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return body, err
+}
+
+// newUpload stores a finished five-byte upload and returns a counter for it.
+func newUpload(t *testing.T, limit string) (*Counter, handler.FileInfo) {
+	t.Helper()
+	cfg := &config.Config{
+		LocalStorageDir:   t.TempDir(),
+		S3ObjectPrefix:    "uploads/",
+		ShortLinkPrefix:   "short/",
+		ExpiryIndexPrefix: "expiry-index/",
+	}
+	local, err := storage.NewLocal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := s3Keys{local}
+	info := handler.FileInfo{ID: "abc", Size: 5, MetaData: handler.MetaData{"max-downloads": limit}}
+	if err := store.Put(context.Background(), store.UploadKey(info.ID), bytes.NewReader([]byte("hello")), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg, store, memorylocker.New()), info
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	c, info := newUpload(t, "2")
+
+	if last, err := c.Acquire(ctx, info.ID, info); err != nil || last {
+		t.Fatalf("first Acquire = %v, %v; want false, nil", last, err)
+	}
+	if err := c.Release(ctx, info.ID, info); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := c.Acquire(ctx, info.ID, info); err != nil || last {
+		t.Fatalf("Acquire after Release = %v, %v; want false, nil", last, err)
+	}
+	if last, err := c.Acquire(ctx, info.ID, info); err != nil || !last {
+		t.Fatalf("second Acquire = %v, %v; want true, nil", last, err)
+	}
+	if _, err := c.Acquire(ctx, info.ID, info); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("third Acquire error = %v, want ErrExhausted", err)
+	}
+}
+
+func TestAcquireUnlimited(t *testing.T) {
+	c, info := newUpload(t, "")
+	for i := 0; i < 3; i++ {
+		if last, err := c.Acquire(context.Background(), info.ID, info); err != nil || last {
+			t.Fatalf("Acquire = %v, %v; want false, nil", last, err)
+		}
+	}
+}
+
+func TestAcquireConcurrent(t *testing.T) {
+	c, info := newUpload(t, "3")
+
+	var wg sync.WaitGroup
+	var served, last atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := c.Acquire(context.Background(), info.ID, info)
+			if errors.Is(err, ErrExhausted) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			served.Add(1)
+			if l {
+				last.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if served.Load() != 3 || last.Load() != 1 {
+		t.Errorf("served %d downloads with %d last; want 3 with 1", served.Load(), last.Load())
+	}
+}
+
+func TestAcquireConcurrentSuffixedIDs(t *testing.T) {
+	c, info := newUpload(t, "1")
+
+	// Both IDs reach the same upload, so only one may download it.
+	ids := []string{info.ID + "+a", info.ID + "+b"}
+	var wg sync.WaitGroup
+	var served atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			_, err := c.Acquire(context.Background(), id, info)
+			if errors.Is(err, ErrExhausted) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			served.Add(1)
+		}(ids[i%2])
+	}
+	wg.Wait()
+
+	if served.Load() != 1 {
+		t.Errorf("served %d downloads, want 1", served.Load())
+	}
+}
+
+func TestBurn(t *testing.T) {
+	ctx := context.Background()
+	c, info := newUpload(t, "1")
+	key := c.store.UploadKey(info.ID)
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err := c.store.SetTags(ctx, key, map[string]string{"expires-at": expiresAt.Format(time.RFC3339)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.index.Add(ctx, key, expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	code, err := c.links.Create(ctx, "", info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.MetaData[shortlink.MetaKey] = code
+
+	if _, err := c.Acquire(ctx, info.ID, info); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Burn(ctx, info.ID, info); err != nil {
+		t.Fatal(err)
+	}
+	// A download broken off while the upload was burnt gives nothing back.
+	if err := c.Release(ctx, info.ID, info); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"uploads/", "short/", "expiry-index/"} {
+		var objs []string
+		err := c.store.List(ctx, prefix, func(obj storage.ObjectInfo) error {
+			objs = append(objs, obj.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objs) != 0 {
+			t.Errorf("objects left under %s after Burn: %v", prefix, objs)
+		}
+	}
+}
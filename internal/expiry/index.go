@@ -0,0 +1,63 @@
+package expiry
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"sharemk/internal/config"
+	"sharemk/internal/storage"
+)
+
+// bucketLayout formats the time bucket an expiry falls into. Buckets are one
+// minute wide and sort lexically in time order, so listing the index returns
+// the soonest expiries first.
+const bucketLayout = "2006-01-02T15:04"
+
+// Index records upload expiries as empty marker objects keyed by time bucket:
+//
+//	expiry-index/2026-10-16T14:05/uploads/3f2a…
+//
+// The worker lists the index in order and stops at the first bucket that has
+// not yet passed, so a scan costs O(expired) instead of O(stored) API calls.
+type Index struct {
+	store  storage.Backend
+	prefix string
+}
+
+func NewIndex(cfg *config.Config, store storage.Backend) *Index {
+	return &Index{store: store, prefix: cfg.ExpiryIndexPrefix}
+}
+
+// Add records that the upload whose data object is stored at key expires at t.
+func (ix *Index) Add(ctx context.Context, key string, t time.Time) error {
+	return ix.store.Put(ctx, ix.markerKey(key, t), bytes.NewReader(nil), 0, "application/octet-stream")
+}
+
+// Remove deletes the marker written by Add for the same key and time.
+func (ix *Index) Remove(ctx context.Context, key string, t time.Time) error {
+	return ix.store.Delete(ctx, ix.markerKey(key, t))
+}
+
+func (ix *Index) markerKey(key string, t time.Time) string {
+	return ix.prefix + t.UTC().Format(bucketLayout) + "/" + key
+}
+
+// parseMarker splits a marker key into the end of its time bucket and the
+// data object key it refers to.
+func (ix *Index) parseMarker(marker string) (bucketEnd time.Time, key string, ok bool) {
+	rest, found := strings.CutPrefix(marker, ix.prefix)
+	if !found {
+		return time.Time{}, "", false
+	}
+	bucket, key, found := strings.Cut(rest, "/")
+	if !found || key == "" {
+		return time.Time{}, "", false
+	}
+	start, err := time.Parse(bucketLayout, bucket)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return start.Add(time.Minute), key, true
+}
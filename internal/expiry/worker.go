@@ -2,32 +2,76 @@ package expiry
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"path"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"go.opentelemetry.io/otel/attribute"
 	"sharemk/internal/config"
+	"sharemk/internal/metrics"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+	"sharemk/internal/tracing"
+	"sharemk/internal/webhook"
 )
 
+// deleteBatchSize is the number of expired uploads collected before the
+// worker issues a delete.
+const deleteBatchSize = 500
+
+// linkGrace is how old a short link must be before reconciliation deletes it
+// for lack of an upload. The MCP server writes a link just before the
+// upload's .info.
+const linkGrace = time.Hour
+
+// errStopListing ends an index listing once a bucket in the future is reached.
+var errStopListing = errors.New("expiry: stop listing")
+
 type Worker struct {
 	cfg      *config.Config
-	s3Client *s3.Client
+	store    storage.Backend
+	index    *Index
+	links    *shortlink.Links
+	notifier *webhook.Notifier
 	interval time.Duration
+
+	// reconcileInterval controls how often the full-scan reconciliation runs;
+	// zero disables it.
+	reconcileInterval time.Duration
+}
+
+// expiredUpload is an upload being deleted, held until the delete succeeds
+// so its upload.expired webhook can be sent.
+type expiredUpload struct {
+	info      handler.FileInfo
+	expiresAt time.Time
 }
 
-func New(cfg *config.Config, s3Client *s3.Client) *Worker {
+func New(cfg *config.Config, store storage.Backend, notifier *webhook.Notifier) *Worker {
 	return &Worker{
-		cfg:      cfg,
-		s3Client: s3Client,
-		interval: 10 * time.Minute,
+		cfg:               cfg,
+		store:             store,
+		index:             NewIndex(cfg, store),
+		links:             shortlink.New(cfg, store),
+		notifier:          notifier,
+		interval:          10 * time.Minute,
+		reconcileInterval: cfg.ExpiryReconcileInterval,
 	}
 }
 
 func (w *Worker) Start(ctx context.Context) {
-	slog.Info("expiry: worker started", "interval", w.interval)
+	slog.Info("expiry: worker started", "interval", w.interval, "reconcile_interval", w.reconcileInterval)
+
+	// Reconcile on startup so uploads made before the index existed, or whose
+	// marker write failed, are picked up without waiting a full interval.
+	var lastReconcile time.Time
+	if w.reconcileInterval > 0 {
+		w.reconcile(ctx)
+		lastReconcile = time.Now()
+	}
 	w.runOnce(ctx)
 
 	ticker := time.NewTicker(w.interval)
@@ -39,90 +83,272 @@ func (w *Worker) Start(ctx context.Context) {
 			slog.Info("expiry: worker stopping")
 			return
 		case <-ticker.C:
+			if w.reconcileInterval > 0 && time.Since(lastReconcile) >= w.reconcileInterval {
+				w.reconcile(ctx)
+				lastReconcile = time.Now()
+			}
 			w.runOnce(ctx)
 		}
 	}
 }
 
+// runOnce deletes the uploads recorded in index buckets that have passed.
 func (w *Worker) runOnce(ctx context.Context) {
-	slog.Info("expiry: scanning for expired objects")
+	slog.Info("expiry: scanning expiry index")
 	now := time.Now().UTC()
+	defer func() { metrics.ExpiryRunDuration.WithLabelValues("sweep").Observe(time.Since(now).Seconds()) }()
+	ctx, span := tracing.Start(ctx, "expiry.sweep")
+	defer span.End()
 	deleted := 0
 
-	paginator := s3.NewListObjectsV2Paginator(w.s3Client, &s3.ListObjectsV2Input{
-		Bucket: aws.String(w.cfg.S3Bucket),
-		Prefix: aws.String(w.cfg.S3ObjectPrefix),
+	var toDelete []string
+	var expired []expiredUpload
+	flush := func() {
+		if len(toDelete) == 0 {
+			return
+		}
+		if err := w.store.Delete(ctx, toDelete...); err != nil {
+			slog.Error("expiry: failed to delete objects", "error", err)
+		} else {
+			w.notifyExpired(expired)
+		}
+		toDelete = toDelete[:0]
+		expired = expired[:0]
+	}
+
+	err := w.store.List(ctx, w.index.prefix, func(obj storage.ObjectInfo) error {
+		bucketEnd, key, ok := w.index.parseMarker(obj.Key)
+		if !ok {
+			slog.Warn("expiry: ignoring malformed index entry", "key", obj.Key)
+			return nil
+		}
+		if bucketEnd.After(now) {
+			return errStopListing
+		}
+
+		// The object's own tag is authoritative: it may have been deleted
+		// already, or given a later expiry since the marker was written.
+		switch expiresAt, tags, err := w.expiresAt(ctx, key); {
+		case errors.Is(err, storage.ErrNotFound):
+			// Infected uploads lose their data object at once but keep
+			// their .info, tagged alike, until now.
+			tags, _ = w.store.GetTags(ctx, key+".info")
+			toDelete = append(toDelete, w.objects(ctx, key, tags)...)
+			toDelete = append(toDelete, obj.Key)
+		case err != nil:
+			slog.Warn("expiry: failed to get tags", "key", key, "error", err)
+			return nil
+		case !expiresAt.IsZero() && now.After(expiresAt) && w.isCollection(key):
+			toDelete = append(toDelete, w.objects(ctx, key, tags)...)
+			toDelete = append(toDelete, obj.Key)
+		case !expiresAt.IsZero() && now.After(expiresAt):
+			expired = w.collectExpired(ctx, expired, key, expiresAt)
+			toDelete = append(toDelete, w.objects(ctx, key, tags)...)
+			toDelete = append(toDelete, obj.Key)
+			deleted++
+		default:
+			toDelete = append(toDelete, obj.Key)
+		}
+
+		if len(toDelete) >= 4*deleteBatchSize {
+			flush()
+		}
+		return nil
 	})
+	if err != nil && !errors.Is(err, errStopListing) {
+		slog.Error("expiry: failed to list index", "error", err)
+	}
+	flush()
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			slog.Error("expiry: failed to list objects", "error", err)
+	metrics.ExpiryDeleted.WithLabelValues("sweep").Add(float64(deleted))
+	span.SetAttributes(attribute.Int("expiry.deleted_uploads", deleted))
+	slog.Info("expiry: scan complete", "deleted_uploads", deleted)
+}
+
+// reconcile lists every stored upload and reads its tags, deleting expired
+// uploads and indexing the rest. It covers uploads made before the expiry
+// index existed and markers lost to failed writes.
+func (w *Worker) reconcile(ctx context.Context) {
+	slog.Info("expiry: reconciling all stored objects")
+	now := time.Now().UTC()
+	defer func() { metrics.ExpiryRunDuration.WithLabelValues("reconcile").Observe(time.Since(now).Seconds()) }()
+	ctx, span := tracing.Start(ctx, "expiry.reconcile")
+	defer span.End()
+	deleted, indexed := 0, 0
+
+	var toDelete []string
+	var expired []expiredUpload
+	pending := 0
+	flush := func() {
+		if len(toDelete) == 0 {
 			return
 		}
+		if err := w.store.Delete(ctx, toDelete...); err != nil {
+			slog.Error("expiry: failed to delete objects", "error", err)
+		} else {
+			deleted += pending
+			w.notifyExpired(expired)
+		}
+		toDelete = toDelete[:0]
+		expired = expired[:0]
+		pending = 0
+	}
 
-		var toDelete []s3types.ObjectIdentifier
-
-		for _, obj := range page.Contents {
-			key := aws.ToString(obj.Key)
+	err := w.store.List(ctx, w.cfg.S3ObjectPrefix, func(obj storage.ObjectInfo) error {
+		key := obj.Key
 
-			// Only process data objects; skip metadata and multipart parts.
-			if strings.HasSuffix(key, ".info") || strings.HasSuffix(key, ".part") {
-				continue
-			}
+		// Only process data objects; skip metadata, multipart parts, download
+		// counters, and the index, collections and short links when they
+		// share the object prefix.
+		if strings.HasSuffix(key, ".info") || strings.HasSuffix(key, ".part") ||
+			strings.HasSuffix(key, ".downloads") || strings.HasPrefix(key, w.index.prefix) ||
+			w.isCollection(key) || strings.HasPrefix(key, w.cfg.ShortLinkPrefix) {
+			return nil
+		}
 
-			tagsOut, err := w.s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
-				Bucket: aws.String(w.cfg.S3Bucket),
-				Key:    aws.String(key),
-			})
-			if err != nil {
-				slog.Warn("expiry: failed to get tags", "key", key, "error", err)
-				continue
-			}
+		tags, err := w.store.GetTags(ctx, key)
+		if err != nil {
+			slog.Warn("expiry: failed to get tags", "key", key, "error", err)
+			return nil
+		}
 
-			expiresAt, found := findTag(tagsOut.TagSet, "expires-at")
-			if !found {
-				continue
-			}
+		expiresAt, found := tags["expires-at"]
+		if !found {
+			return nil
+		}
 
-			t, err := time.Parse(time.RFC3339, expiresAt)
-			if err != nil {
-				slog.Warn("expiry: invalid expires-at tag", "key", key, "value", expiresAt)
-				continue
-			}
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			slog.Warn("expiry: invalid expires-at tag", "key", key, "value", expiresAt)
+			return nil
+		}
 
-			if now.After(t) {
-				toDelete = append(toDelete,
-					s3types.ObjectIdentifier{Key: aws.String(key)},
-					s3types.ObjectIdentifier{Key: aws.String(key + ".info")},
-				)
+		if now.After(t) {
+			expired = w.collectExpired(ctx, expired, key, t)
+			toDelete = append(toDelete, w.objects(ctx, key, tags)...)
+			pending++
+			if pending >= deleteBatchSize {
+				flush()
 			}
+			return nil
 		}
 
-		if len(toDelete) == 0 {
-			continue
+		if err := w.index.Add(ctx, key, t); err != nil {
+			slog.Warn("expiry: failed to index object", "key", key, "error", err)
+			return nil
 		}
+		indexed++
+		return nil
+	})
+	if err != nil {
+		slog.Error("expiry: failed to list objects", "error", err)
+	}
+	flush()
+
+	links := w.reconcileLinks(ctx)
 
-		_, err = w.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-			Bucket: aws.String(w.cfg.S3Bucket),
-			Delete: &s3types.Delete{Objects: toDelete, Quiet: aws.Bool(true)},
-		})
+	metrics.ExpiryDeleted.WithLabelValues("reconcile").Add(float64(deleted))
+	span.SetAttributes(
+		attribute.Int("expiry.deleted_uploads", deleted),
+		attribute.Int("expiry.indexed_uploads", indexed),
+		attribute.Int("expiry.deleted_links", links),
+	)
+	slog.Info("expiry: reconciliation complete", "deleted_uploads", deleted, "indexed_uploads", indexed, "deleted_links", links)
+}
+
+// reconcileLinks deletes short links whose upload no longer exists, such as
+// links left behind by a failed delete, and returns how many it deleted.
+func (w *Worker) reconcileLinks(ctx context.Context) int {
+	var dangling []string
+	err := w.store.List(ctx, w.cfg.ShortLinkPrefix, func(obj storage.ObjectInfo) error {
+		if time.Since(obj.LastModified) < linkGrace {
+			return nil
+		}
+		id, err := w.links.Resolve(ctx, strings.TrimPrefix(obj.Key, w.cfg.ShortLinkPrefix))
 		if err != nil {
-			slog.Error("expiry: failed to delete objects", "error", err)
-			continue
+			return nil
 		}
-
-		deleted += len(toDelete) / 2
+		_, err = w.store.Stat(ctx, w.store.UploadKey(id)+".info")
+		if errors.Is(err, storage.ErrNotFound) {
+			dangling = append(dangling, obj.Key)
+		} else if err != nil {
+			slog.Warn("expiry: failed to check short link", "key", obj.Key, "error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("expiry: failed to list short links", "error", err)
 	}
+	if len(dangling) == 0 {
+		return 0
+	}
+	if err := w.store.Delete(ctx, dangling...); err != nil {
+		slog.Error("expiry: failed to delete short links", "error", err)
+		return 0
+	}
+	return len(dangling)
+}
 
-	slog.Info("expiry: scan complete", "deleted_uploads", deleted)
+// isCollection reports whether the indexed key is a collection record
+// rather than the data object of an upload.
+func (w *Worker) isCollection(key string) bool {
+	return strings.HasPrefix(key, w.cfg.CollectionPrefix)
 }
 
-func findTag(tags []s3types.Tag, key string) (string, bool) {
-	for _, t := range tags {
-		if aws.ToString(t.Key) == key {
-			return aws.ToString(t.Value), true
+// objects returns the keys to delete for the indexed key with tags: the
+// objects of an upload and its short link, or everything in a collection's
+// directory (see package collection).
+func (w *Worker) objects(ctx context.Context, key string, tags map[string]string) []string {
+	if !w.isCollection(key) {
+		keys := storage.UploadObjects(key)
+		if code := tags[shortlink.MetaKey]; code != "" {
+			keys = append(keys, w.links.Key(code))
 		}
+		return keys
+	}
+	keys := []string{key}
+	err := w.store.List(ctx, path.Dir(key)+"/", func(obj storage.ObjectInfo) error {
+		if obj.Key != key {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Warn("expiry: failed to list collection", "key", key, "error", err)
+	}
+	return keys
+}
+
+// expiresAt returns the time in the expires-at tag on key, or the zero time
+// if the object has no valid tag, along with all of its tags.
+func (w *Worker) expiresAt(ctx context.Context, key string) (time.Time, map[string]string, error) {
+	tags, err := w.store.GetTags(ctx, key)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	t, err := time.Parse(time.RFC3339, tags["expires-at"])
+	if err != nil {
+		return time.Time{}, tags, nil
+	}
+	return t, tags, nil
+}
+
+// collectExpired appends the upload stored at key to expired for its
+// webhook. The .info object is only read when webhooks are enabled.
+func (w *Worker) collectExpired(ctx context.Context, expired []expiredUpload, key string, expiresAt time.Time) []expiredUpload {
+	if !w.notifier.Enabled() {
+		return expired
+	}
+	info, err := storage.ReadInfo(ctx, w.store, key)
+	if err != nil {
+		slog.Warn("expiry: failed to read upload info for webhook", "key", key, "error", err)
+		return expired
+	}
+	return append(expired, expiredUpload{info: info, expiresAt: expiresAt})
+}
+
+func (w *Worker) notifyExpired(expired []expiredUpload) {
+	for _, u := range expired {
+		w.notifier.Notify(webhook.UploadExpired, u.info, u.expiresAt)
 	}
-	return "", false
 }
@@ -3,105 +3,384 @@ package hooks
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"strconv"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/tus/tusd/v2/pkg/handler"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sharemk/internal/clientip"
+	"sharemk/internal/collection"
 	"sharemk/internal/config"
+	"sharemk/internal/contenttype"
+	"sharemk/internal/downloads"
+	"sharemk/internal/expiry"
+	"sharemk/internal/lifetime"
+	"sharemk/internal/manage"
+	"sharemk/internal/password"
+	"sharemk/internal/scan"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+	"sharemk/internal/tracing"
+	"sharemk/internal/webhook"
 )
 
-var validExpiries = map[string]time.Duration{
-	"1h":  1 * time.Hour,
-	"6h":  6 * time.Hour,
-	"24h": 24 * time.Hour,
-	"7d":  7 * 24 * time.Hour,
-	"30d": 30 * 24 * time.Hour,
-}
+// Bounds on the plaintext chunk size of end-to-end encrypted uploads. The
+// browser holds a chunk in memory while encrypting or decrypting it.
+const (
+	minE2EChunkSize = 1 << 10
+	maxE2EChunkSize = 16 << 20
+)
 
 type Hooks struct {
-	cfg      *config.Config
-	s3Client *s3.Client
+	cfg         *config.Config
+	store       storage.Backend
+	index       *expiry.Index
+	policy      lifetime.Policy
+	types       contenttype.Policy
+	collections *collection.Collections
+	links       *shortlink.Links
+	notifier    *webhook.Notifier
+	scanner     *scan.Scanner
 }
 
-func New(cfg *config.Config, s3Client *s3.Client) *Hooks {
-	return &Hooks{cfg: cfg, s3Client: s3Client}
+func New(cfg *config.Config, store storage.Backend, notifier *webhook.Notifier, scanner *scan.Scanner) *Hooks {
+	return &Hooks{
+		cfg:         cfg,
+		store:       store,
+		index:       expiry.NewIndex(cfg, store),
+		policy:      lifetime.Policy{Min: cfg.ExpiryMin, Max: cfg.ExpiryMax, Default: cfg.ExpiryDefault},
+		types:       contenttype.Policy{Allow: cfg.ContentTypesAllow, Deny: cfg.ContentTypesDeny},
+		collections: collection.New(cfg, store),
+		links:       shortlink.New(cfg, store),
+		notifier:    notifier,
+		scanner:     scanner,
+	}
 }
 
-// PreCreate validates the expires-in metadata and injects a default if absent.
+// PreCreate validates the metadata of a new upload and rewrites it into the
+// form the server stores, answering 4xx if anything is wrong. The checks
+// are made by helpers such as lifetime.Policy.Resolve, collection.CleanPath
+// and shortlink.Links.Check. The management token is returned once, in the
+// Upload-Management-Token header.
 func (h *Hooks) PreCreate(event handler.HookEvent) (handler.HTTPResponse, handler.FileInfoChanges, error) {
-	expiry := event.Upload.MetaData["expires-in"]
+	_, span := tracing.Start(event.Context, "hooks.PreCreate")
+	resp, changes, err := h.preCreate(event)
+	tracing.End(span, err)
+	return resp, changes, err
+}
+
+func (h *Hooks) preCreate(event handler.HookEvent) (handler.HTTPResponse, handler.FileInfoChanges, error) {
+	meta := make(handler.MetaData, len(event.Upload.MetaData)+1)
+	for k, v := range event.Upload.MetaData {
+		meta[k] = v
+	}
 
-	if expiry == "" {
-		expiry = "24h"
+	// Members of a collection expire with it, and anyone with its link can
+	// download them, so they cannot have restrictions of their own.
+	if id, ok := meta[collection.IDKey]; ok {
+		col, err := h.collections.Authorize(event.Context, id, meta[collection.TokenKey])
+		if errors.Is(err, collection.ErrUnauthorized) {
+			return reject(err.Error())
+		}
+		if err != nil {
+			return handler.HTTPResponse{}, handler.FileInfoChanges{}, err
+		}
+		for _, k := range []string{"expires-in", "expires-at", "max-downloads", "password", "e2e", "encrypt"} {
+			if _, set := meta[k]; set {
+				return reject(fmt.Sprintf("%s cannot be set on uploads in a collection", k))
+			}
+		}
+		if _, encrypted := storage.EncryptionKey(event.Context); encrypted {
+			return reject("uploads in a collection cannot be encrypted")
+		}
+		meta["expires-at"] = col.ExpiresAt.Format(time.RFC3339)
+
+		if p, ok := meta[collection.PathKey]; ok {
+			clean, err := collection.CleanPath(p)
+			if err != nil {
+				return reject(err.Error())
+			}
+			meta[collection.PathKey] = clean
+		}
+	} else if _, ok := meta[collection.PathKey]; ok {
+		return reject("path can only be set on uploads in a collection")
+	}
+	delete(meta, collection.TokenKey)
+
+	// The link is created by PreFinish; a slug that cannot be had is
+	// refused now, before any data is sent.
+	delete(meta, shortlink.MetaKey)
+	switch err := h.links.Check(event.Context, meta[shortlink.SlugKey]); {
+	case errors.Is(err, shortlink.ErrTaken):
+		return handler.HTTPResponse{}, handler.FileInfoChanges{}, slugTaken(err)
+	case errors.Is(err, shortlink.ErrInvalidSlug), errors.Is(err, shortlink.ErrSlugsDisabled):
+		return reject(err.Error())
+	case err != nil:
+		return handler.HTTPResponse{}, handler.FileInfoChanges{}, err
+	}
+
+	if _, err := h.policy.Resolve(meta["expires-in"], meta["expires-at"], time.Now()); err != nil {
+		return reject(err.Error())
+	}
+	if meta["expires-in"] == "" && meta["expires-at"] == "" {
 		// Inject the default back so PostFinish can read it.
-		changes := handler.FileInfoChanges{
-			MetaData: event.Upload.MetaData,
+		meta["expires-in"] = lifetime.Format(h.policy.Default)
+	}
+
+	if v, ok := meta["max-downloads"]; ok {
+		if _, valid := downloads.Limit(meta); !valid {
+			return reject(fmt.Sprintf("invalid max-downloads %q; must be a positive integer", v))
 		}
-		if changes.MetaData == nil {
-			changes.MetaData = make(handler.MetaData)
+	}
+
+	if v, ok := meta["e2e"]; ok {
+		if v != "1" {
+			return reject(fmt.Sprintf("invalid e2e %q; must be 1", v))
+		}
+		n, err := strconv.Atoi(meta["e2e-chunk-size"])
+		if err != nil || n < minE2EChunkSize || n > maxE2EChunkSize {
+			return reject(fmt.Sprintf("invalid e2e-chunk-size %q; must be between %d and %d", meta["e2e-chunk-size"], minE2EChunkSize, maxE2EChunkSize))
+		}
+	}
+
+	// The declared type is checked again against the content on completion;
+	// rejecting it now saves sending the data first.
+	if declared := contenttype.Declared(meta); declared != "" {
+		if err := h.types.Check(declared); err != nil {
+			return rejectType(err.Error())
+		}
+	}
+	delete(meta, contenttype.MetaKey)
+
+	if u, ok := meta[webhook.URLKey]; ok {
+		if !h.cfg.WebhookPerUpload {
+			return reject("per-upload webhooks are not enabled on this server")
+		}
+		if err := webhook.CheckURL(u); err != nil {
+			return reject(err.Error())
+		}
+	}
+
+	// Never trust a client-supplied hash; it must come from a password.
+	delete(meta, "password-hash")
+	if pw, ok := meta["password"]; ok {
+		if pw == "" {
+			return reject("password must not be empty")
 		}
-		changes.MetaData["expires-in"] = expiry
-		return handler.HTTPResponse{}, changes, nil
+		hash, err := password.Hash(pw)
+		if err != nil {
+			return handler.HTTPResponse{}, handler.FileInfoChanges{}, err
+		}
+		delete(meta, "password")
+		meta["password-hash"] = hash
+	}
+
+	// The server attaches a fresh SSE-C key to the creation request when the
+	// upload is to be encrypted; only a hash of it is kept.
+	delete(meta, "encryption")
+	delete(meta, "encryption-key-hash")
+	if key, ok := storage.EncryptionKey(event.Context); ok {
+		meta["encryption"] = "sse-c"
+		meta["encryption-key-hash"] = storage.EncryptionKeyHash(key)
+	} else if storage.EncryptionRequested(meta) {
+		return reject("encryption is not enabled on this server")
 	}
+	delete(meta, "encrypt")
+
+	h.scanner.Prepare(meta)
 
-	if _, ok := validExpiries[expiry]; !ok {
-		body, _ := json.Marshal(map[string]string{
-			"error": fmt.Sprintf("invalid expires-in %q; valid values: 1h, 6h, 24h, 7d, 30d", expiry),
-		})
-		return handler.HTTPResponse{
-			StatusCode: 400,
+	token, err := manage.GenerateToken()
+	if err != nil {
+		return handler.HTTPResponse{}, handler.FileInfoChanges{}, err
+	}
+	meta["mgmt-token"] = token
+
+	resp := handler.HTTPResponse{Header: handler.HTTPHeader{"Upload-Management-Token": token}}
+	return resp, handler.FileInfoChanges{MetaData: meta}, nil
+}
+
+// reject aborts upload creation with a 400 and a JSON error body. tusd only
+// stops creating the upload when the hook returns an error; a bare
+// HTTPResponse would be merged into the success response instead.
+func reject(msg string) (handler.HTTPResponse, handler.FileInfoChanges, error) {
+	return handler.HTTPResponse{}, handler.FileInfoChanges{}, hookError("ERR_INVALID_METADATA", 400, msg)
+}
+
+// rejectType aborts upload creation with a 415 for a file type the server
+// does not accept.
+func rejectType(msg string) (handler.HTTPResponse, handler.FileInfoChanges, error) {
+	return handler.HTTPResponse{}, handler.FileInfoChanges{}, hookError("ERR_FILE_TYPE_NOT_ALLOWED", 415, msg)
+}
+
+// slugTaken aborts an upload whose slug another upload has.
+func slugTaken(err error) handler.Error {
+	return hookError("ERR_SLUG_TAKEN", 409, err.Error())
+}
+
+// hookError is a hook error tusd sends to the client as a JSON error body.
+func hookError(code string, status int, msg string) handler.Error {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	return handler.Error{
+		ErrorCode: code,
+		Message:   msg,
+		HTTPResponse: handler.HTTPResponse{
+			StatusCode: status,
 			Header:     handler.HTTPHeader{"Content-Type": "application/json"},
 			Body:       string(body),
-		}, handler.FileInfoChanges{}, nil
+		},
 	}
+}
 
-	return handler.HTTPResponse{}, handler.FileInfoChanges{}, nil
+// PreFinish runs once the last byte of an upload has been stored, before the
+// final PATCH is answered. It detects the file's type from its first bytes
+// and records it in the metadata; if the server does not accept the type,
+// the upload is deleted and the PATCH fails with a 415. It then links a
+// short code, or the slug the uploader asked for, to the upload; the link is
+// returned in the Upload-Short-URL header.
+func (h *Hooks) PreFinish(event handler.HookEvent) (handler.HTTPResponse, error) {
+	ctx, span := tracing.Start(event.Context, "hooks.PreFinish")
+	resp, err := h.preFinish(ctx, event)
+	tracing.End(span, err)
+	return resp, err
 }
 
-// HandleComplete tags the S3 object with its expiry time after a successful upload.
-func (h *Hooks) HandleComplete(event handler.HookEvent) {
-	key, ok := event.Upload.Storage["Key"]
-	if !ok || key == "" {
-		slog.Error("hooks: missing S3 key in upload storage", "upload_id", event.Upload.ID)
-		return
+func (h *Hooks) preFinish(ctx context.Context, event handler.HookEvent) (handler.HTTPResponse, error) {
+	key := h.store.UploadKey(event.Upload.ID)
+	info := event.Upload
+
+	// End-to-end encrypted data is indistinguishable from random bytes.
+	detected := contenttype.Octet
+	if info.MetaData["e2e"] != "1" {
+		head, err := readHead(ctx, h.store, key)
+		if err != nil {
+			return handler.HTTPResponse{}, err
+		}
+		detected = contenttype.Detect(head, info.MetaData["filename"])
+	}
+
+	if err := h.types.Check(detected); err != nil {
+		slog.Info("hooks: rejected upload by detected type", "upload_id", info.ID, "detected_type", detected, "client_ip", clientip.Host(event.HTTPRequest.RemoteAddr))
+		h.deleteRejected(ctx, info)
+		return handler.HTTPResponse{}, hookError("ERR_FILE_TYPE_NOT_ALLOWED", 415, err.Error())
+	}
+
+	// PreCreate checked the slug, but another upload may have claimed it
+	// since.
+	code, err := h.links.Create(ctx, info.MetaData[shortlink.SlugKey], info.ID)
+	if errors.Is(err, shortlink.ErrTaken) {
+		h.deleteRejected(ctx, info)
+		return handler.HTTPResponse{}, slugTaken(err)
+	}
+	if err != nil {
+		return handler.HTTPResponse{}, err
+	}
+
+	meta := make(handler.MetaData, len(info.MetaData)+2)
+	for k, v := range info.MetaData {
+		meta[k] = v
 	}
+	delete(meta, shortlink.SlugKey)
+	meta[shortlink.MetaKey] = code
+	meta[contenttype.MetaKey] = detected
+	info.MetaData = meta
+	if err := storage.WriteInfo(ctx, h.store, key, info); err != nil {
+		h.links.Delete(context.WithoutCancel(ctx), code) //nolint:errcheck
+		return handler.HTTPResponse{}, err
+	}
+	return handler.HTTPResponse{Header: handler.HTTPHeader{"Upload-Short-URL": h.links.URL(code)}}, nil
+}
 
-	expiry := event.Upload.MetaData["expires-in"]
-	if expiry == "" {
-		expiry = "24h"
+// deleteRejected deletes an upload PreFinish refuses.
+func (h *Hooks) deleteRejected(ctx context.Context, info handler.FileInfo) {
+	if err := h.store.Delete(context.WithoutCancel(ctx), storage.UploadObjects(h.store.UploadKey(info.ID))...); err != nil {
+		slog.Error("hooks: failed to delete rejected upload", "upload_id", info.ID, "error", err)
 	}
+}
 
-	dur, ok := validExpiries[expiry]
-	if !ok {
-		slog.Error("hooks: invalid expires-in in metadata", "value", expiry, "upload_id", event.Upload.ID)
-		return
+// readHead returns up to contenttype.SniffLen leading bytes of the object
+// stored at key.
+func readHead(ctx context.Context, store storage.Backend, key string) ([]byte, error) {
+	body, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
 	}
+	defer body.Close()
 
-	expiresAt := time.Now().UTC().Add(dur).Format(time.RFC3339)
+	head := make([]byte, contenttype.SniffLen)
+	n, err := io.ReadFull(body, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return head[:n], nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+// HandleComplete tags the stored object with its expiry time after a
+// successful upload and records the expiry in the index, and adds the upload
+// to its collection, if any. It then scans the upload for malware and sends
+// the upload.completed webhook.
+//
+// It runs after the final PATCH has been answered, but keeps that request's
+// context (without its cancellation) so its span joins the upload's trace.
+func (h *Hooks) HandleComplete(event handler.HookEvent) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(event.Context), 30*time.Second)
 	defer cancel()
+	ctx, span := tracing.Start(ctx, "hooks.HandleComplete",
+		trace.WithAttributes(attribute.String("upload.id", event.Upload.ID)))
+	defer span.End()
 
-	tags := &s3types.Tagging{
-		TagSet: []s3types.Tag{
-			{Key: aws.String("expires-at"), Value: aws.String(expiresAt)},
-		},
+	key := h.store.UploadKey(event.Upload.ID)
+	meta := event.Upload.MetaData
+
+	// PreFinish has since added the detected type to the stored metadata.
+	info, err := storage.ReadInfo(ctx, h.store, key)
+	if err != nil {
+		slog.Warn("hooks: failed to reload upload info", "upload_id", event.Upload.ID, "error", err)
+		info = event.Upload
+	}
+
+	now := time.Now()
+	expiresTime, err := h.policy.Resolve(meta["expires-in"], meta["expires-at"], now)
+	if err != nil {
+		// PreCreate already validated the metadata, but an absolute expires-at
+		// can fall below the minimum while a slow upload is in progress.
+		slog.Warn("hooks: expiry out of bounds at completion, using minimum", "upload_id", event.Upload.ID, "error", err)
+		expiresTime = now.UTC().Add(h.policy.Min).Truncate(time.Second)
+	}
+	expiresAt := expiresTime.Format(time.RFC3339)
+
+	// The short code lets the expiry worker delete the link with the upload.
+	tags := map[string]string{"expires-at": expiresAt}
+	if code := info.MetaData[shortlink.MetaKey]; code != "" {
+		tags[shortlink.MetaKey] = code
 	}
 
 	for _, k := range []string{key, key + ".info"} {
-		_, err := h.s3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
-			Bucket:  aws.String(h.cfg.S3Bucket),
-			Key:     aws.String(k),
-			Tagging: tags,
-		})
-		if err != nil {
+		if err := h.store.SetTags(ctx, k, tags); err != nil {
 			slog.Error("hooks: failed to tag object", "key", k, "error", err)
 		}
 	}
 
-	slog.Info("hooks: tagged upload with expiry", "upload_id", event.Upload.ID, "expires_at", expiresAt)
+	// A missing marker is recovered by the worker's reconciliation scan.
+	if err := h.index.Add(ctx, key, expiresTime); err != nil {
+		slog.Error("hooks: failed to index expiry", "key", key, "error", err)
+	}
+
+	slog.Info("hooks: tagged upload with expiry", "upload_id", event.Upload.ID, "expires_at", expiresAt, "client_ip", clientip.Host(event.HTTPRequest.RemoteAddr))
+
+	if id := meta[collection.IDKey]; id != "" {
+		if err := h.collections.Add(ctx, id, event.Upload.ID); err != nil {
+			slog.Error("hooks: failed to add upload to collection", "upload_id", event.Upload.ID, "collection_id", id, "error", err)
+		}
+	}
+
+	// Scanning reads the whole file back and may take longer than the
+	// timeout above. The request context still carries the SSE-C key.
+	info = h.scanner.Scan(context.WithoutCancel(ctx), key, info)
+
+	h.notifier.Notify(webhook.UploadCompleted, info, expiresTime)
 }
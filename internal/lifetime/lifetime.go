@@ -0,0 +1,192 @@
+// Package lifetime parses and validates how long an upload is kept. It is
+// shared by the tus pre-create hook and the MCP upload tool so both accept
+// exactly the same expires-in and expires-at values.
+package lifetime
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	day  = 24 * time.Hour
+	week = 7 * day
+)
+
+var (
+	// isoPattern matches ISO-8601 durations such as P2W, P3D or P1DT12H.
+	isoPattern = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+	// goPattern splits week and day components off the front of a Go-style
+	// duration, which time.ParseDuration does not understand.
+	goPattern = regexp.MustCompile(`^(?:(\d+)w)?(?:(\d+)d)?(.*)$`)
+)
+
+// ParseDuration parses a Go-style duration extended with day and week units
+// ("90m", "3d", "1w2d12h") or an ISO-8601 duration ("P2W", "PT90M",
+// "P1DT12H"). Calendar years and months are rejected because their length
+// varies. The result is always positive.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	var d time.Duration
+	var err error
+	if strings.HasPrefix(strings.ToUpper(s), "P") {
+		d, err = parseISO(strings.ToUpper(s))
+	} else {
+		d, err = parseGo(s)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+	return d, nil
+}
+
+func parseISO(s string) (time.Duration, error) {
+	m := isoPattern.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("invalid ISO-8601 duration %q", s)
+	}
+	if m[1] != "" || m[2] != "" {
+		return 0, fmt.Errorf("invalid duration %q: years and months are not supported, use weeks or days", s)
+	}
+
+	var d time.Duration
+	for i, unit := range []time.Duration{week, day, time.Hour, time.Minute} {
+		if v := m[i+3]; v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid ISO-8601 duration %q", s)
+			}
+			if d, err = add(d, n, unit); err != nil {
+				return 0, fmt.Errorf("duration %q: %w", s, err)
+			}
+		}
+	}
+	if v := m[7]; v != "" {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ISO-8601 duration %q", s)
+		}
+		if secs >= math.MaxInt64/float64(time.Second) {
+			return 0, fmt.Errorf("duration %q: %w", s, errTooLong)
+		}
+		if d, err = add(d, 1, time.Duration(secs*float64(time.Second))); err != nil {
+			return 0, fmt.Errorf("duration %q: %w", s, err)
+		}
+	}
+	return d, nil
+}
+
+func parseGo(s string) (time.Duration, error) {
+	m := goPattern.FindStringSubmatch(s)
+	var d time.Duration
+	if m[1] != "" {
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		if d, err = add(d, n, week); err != nil {
+			return 0, fmt.Errorf("duration %q: %w", s, err)
+		}
+	}
+	if m[2] != "" {
+		n, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		if d, err = add(d, n, day); err != nil {
+			return 0, fmt.Errorf("duration %q: %w", s, err)
+		}
+	}
+	if rest := m[3]; rest != "" || (m[1] == "" && m[2] == "") {
+		r, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q; use e.g. 90m, 72h, 3d or P2W", s)
+		}
+		if d, err = add(d, 1, r); err != nil {
+			return 0, fmt.Errorf("duration %q: %w", s, err)
+		}
+	}
+	return d, nil
+}
+
+// errTooLong is returned for durations that do not fit in a time.Duration,
+// about 292 years.
+var errTooLong = errors.New("too long")
+
+// add returns d + n*unit, or errTooLong if that overflows.
+func add(d time.Duration, n int64, unit time.Duration) (time.Duration, error) {
+	if unit > 0 && n > math.MaxInt64/int64(unit) {
+		return 0, errTooLong
+	}
+	e := time.Duration(n) * unit
+	if e > 0 && d > math.MaxInt64-e {
+		return 0, errTooLong
+	}
+	return d + e, nil
+}
+
+// Format renders d compactly in the syntax ParseDuration accepts, e.g. "7d",
+// "36h" or "1h30m".
+func Format(d time.Duration) string {
+	if d > day && d%day == 0 {
+		return strconv.FormatInt(int64(d/day), 10) + "d"
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// Policy holds the operator-configured bounds on upload lifetimes.
+type Policy struct {
+	Min     time.Duration
+	Max     time.Duration
+	Default time.Duration
+}
+
+// Resolve returns when an upload should expire, given the expires-in
+// duration or the absolute RFC 3339 expires-at timestamp it asked for. At
+// most one of them may be set; with neither, the default applies. The
+// resulting lifetime, measured from now, must lie within the policy bounds.
+func (p Policy) Resolve(expiresIn, expiresAt string, now time.Time) (time.Time, error) {
+	var d time.Duration
+	switch {
+	case expiresIn != "" && expiresAt != "":
+		return time.Time{}, errors.New("set only one of expires-in and expires-at")
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expires-at %q; must be an RFC 3339 timestamp such as 2026-10-19T17:00:00Z", expiresAt)
+		}
+		d = t.Sub(now)
+	case expiresIn != "":
+		var err error
+		d, err = ParseDuration(expiresIn)
+		if err != nil {
+			return time.Time{}, err
+		}
+	default:
+		d = p.Default
+	}
+
+	if d < p.Min {
+		return time.Time{}, fmt.Errorf("expiry must be at least %s from now", Format(p.Min))
+	}
+	if d > p.Max {
+		return time.Time{}, fmt.Errorf("expiry must be at most %s from now", Format(p.Max))
+	}
+	return now.Add(d).UTC().Truncate(time.Second), nil
+}
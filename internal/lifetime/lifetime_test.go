@@ -0,0 +1,119 @@
+package lifetime
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr string
+	}{
+		{in: "90m", want: 90 * time.Minute},
+		{in: "72h", want: 72 * time.Hour},
+		{in: "7d", want: week},
+		{in: "1w2d12h", want: week + 2*day + 12*time.Hour},
+		{in: " 3d ", want: 3 * day},
+		{in: "P2W", want: 2 * week},
+		{in: "p3d", want: 3 * day},
+		{in: "PT1H30M", want: 90 * time.Minute},
+		{in: "P1DT12H", want: day + 12*time.Hour},
+		{in: "PT1.5S", want: 1500 * time.Millisecond},
+		{in: "15250w", want: 15250 * week},
+
+		{in: "", wantErr: "invalid duration"},
+		{in: "abc", wantErr: "invalid duration"},
+		{in: "3x", wantErr: "invalid duration"},
+		{in: "0h", wantErr: "must be positive"},
+		{in: "1d-48h", wantErr: "must be positive"},
+		{in: "P", wantErr: "invalid ISO-8601"},
+		{in: "P1DT", wantErr: "invalid ISO-8601"},
+		{in: "PT", wantErr: "invalid ISO-8601"},
+		{in: "P1H", wantErr: "invalid ISO-8601"},
+		{in: "P1Y", wantErr: "years and months"},
+		{in: "P2M", wantErr: "years and months"},
+		{in: "P0D", wantErr: "must be positive"},
+
+		{in: "15251w", wantErr: "too long"},
+		{in: "106752d", wantErr: "too long"},
+		{in: "99999999999999w", wantErr: "too long"},
+		{in: "15250w7d", wantErr: "too long"},
+		{in: "106751d2562047h", wantErr: "too long"},
+		{in: "P15251W", wantErr: "too long"},
+		{in: "P106752D", wantErr: "too long"},
+		{in: "P15250W7D", wantErr: "too long"},
+		{in: "PT9223372037S", wantErr: "too long"},
+		{in: "P106751DT100000H", wantErr: "too long"},
+		{in: "99999999999999999999w", wantErr: "invalid duration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseDuration(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseDuration(%q) = %v, %v; want error containing %q", tt.in, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("ParseDuration(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		in   time.Duration
+		want string
+	}{
+		{week, "7d"},
+		{36 * time.Hour, "36h"},
+		{day, "24h"},
+		{90 * time.Minute, "1h30m"},
+		{30 * time.Second, "30s"},
+	}
+	for _, tt := range tests {
+		if got := Format(tt.in); got != tt.want {
+			t.Errorf("Format(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	p := Policy{Min: time.Hour, Max: 30 * day, Default: day}
+	tests := []struct {
+		name                 string
+		expiresIn, expiresAt string
+		want                 time.Time
+		wantErr              string
+	}{
+		{name: "default", want: now.Add(day)},
+		{name: "expires-in", expiresIn: "7d", want: now.Add(week)},
+		{name: "expires-at", expiresAt: "2026-10-20T12:00:00Z", want: now.Add(4 * day)},
+		{name: "both", expiresIn: "7d", expiresAt: "2026-10-20T12:00:00Z", wantErr: "only one"},
+		{name: "too short", expiresIn: "30m", wantErr: "at least 1h"},
+		{name: "too long", expiresIn: "P5W", wantErr: "at most 30d"},
+		{name: "overflow", expiresIn: "99999999w", wantErr: "too long"},
+		{name: "in the past", expiresAt: "2026-10-16T11:00:00Z", wantErr: "at least"},
+		{name: "bad timestamp", expiresAt: "tomorrow", wantErr: "RFC 3339"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Resolve(tt.expiresIn, tt.expiresAt, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Resolve = %v, %v; want error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !got.Equal(tt.want) {
+				t.Fatalf("Resolve = %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+}
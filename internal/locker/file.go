@@ -0,0 +1,154 @@
+//go:build unix
+
+package locker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// File locks uploads with flock(2) on "<id>.lock" files in a directory that
+// all replicas share, such as an NFS mount next to the local storage
+// backend. The kernel drops the lock when its holder exits, so a crashed
+// replica never leaves an upload locked.
+type File struct {
+	dir string
+}
+
+// NewFile returns a locker keeping its lock files in dir, creating it if
+// needed.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &File{dir: dir}, nil
+}
+
+// UseIn registers the locker in the composer.
+func (l *File) UseIn(composer *handler.StoreComposer) {
+	composer.UseLocker(l)
+}
+
+func (l *File) NewLock(id string) (handler.Lock, error) {
+	if !validID(id) {
+		return nil, handler.ErrNotFound
+	}
+	return &fileLock{
+		path:    filepath.Join(l.dir, id+".lock"),
+		release: filepath.Join(l.dir, id+".release"),
+	}, nil
+}
+
+type fileLock struct {
+	path    string
+	release string
+
+	f    *os.File
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// Lock takes the lock, asking the current holder to release it and retrying
+// until ctx is done.
+func (l *fileLock) Lock(ctx context.Context, requestRelease func()) error {
+	for {
+		f, err := l.tryLock()
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			l.f = f
+			break
+		}
+
+		touch(l.release)
+		select {
+		case <-ctx.Done():
+			return handler.ErrLockTimeout
+		case <-time.After(pollInterval):
+		}
+	}
+
+	// A release marker left from before belongs to the previous holder.
+	os.Remove(l.release)
+
+	l.stop = make(chan struct{})
+	l.done.Add(1)
+	go l.watch(requestRelease)
+	return nil
+}
+
+// tryLock returns the locked lock file, or nil if another process holds it.
+func (l *fileLock) tryLock() (*os.File, error) {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		f.Close()
+		return nil, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// The previous holder removes the file before unlocking it. If that
+	// happened after we opened it, we locked a file nobody else will look
+	// at; start over with the new one.
+	opened, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	current, err := os.Stat(l.path)
+	if err != nil || !os.SameFile(opened, current) {
+		f.Close()
+		return nil, nil
+	}
+	return f, nil
+}
+
+// watch calls requestRelease once another process has left a release
+// marker.
+func (l *fileLock) watch(requestRelease func()) {
+	defer l.done.Done()
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			if _, err := os.Stat(l.release); err == nil {
+				requestRelease()
+				return
+			}
+		}
+	}
+}
+
+func (l *fileLock) Unlock() error {
+	close(l.stop)
+	l.done.Wait()
+
+	// Remove the file while still holding the lock; see tryLock.
+	os.Remove(l.path)
+	os.Remove(l.release)
+	return l.f.Close()
+}
+
+// touch creates an empty file at path if it does not exist yet.
+func touch(path string) {
+	if f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+		f.Close()
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package locker
+
+import (
+	"errors"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// File is only available on Unix systems, which provide flock(2).
+type File struct{}
+
+func NewFile(dir string) (*File, error) {
+	return nil, errors.New("locker: LOCKER=file is not supported on this platform")
+}
+
+func (l *File) UseIn(composer *handler.StoreComposer) {}
+
+func (l *File) NewLock(id string) (handler.Lock, error) {
+	return nil, errors.ErrUnsupported
+}
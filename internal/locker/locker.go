@@ -0,0 +1,61 @@
+// Package locker provides the upload locks tusd takes around every request
+// that reads or modifies an upload, so that two PATCH requests cannot write
+// to the same upload at once.
+//
+// tusd's in-memory locker only works within one process. When several
+// replicas serve the same storage, a client resuming an upload may reach a
+// different replica than the one still handling its previous request, so the
+// lock has to live somewhere all replicas can see: a lock file on a shared
+// volume (LOCKER=file) or a lock object in the bucket (LOCKER=s3).
+//
+// Like tusd's lockers, a replica waiting for a lock asks the holder to let
+// go, which makes tusd stop the holder's request early. Across processes this
+// is done with a release marker next to the lock that the holder watches.
+package locker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/memorylocker"
+	"sharemk/internal/config"
+)
+
+// pollInterval is how often a waiting replica retries a held lock and how
+// often a holder checks for a release request.
+const pollInterval = 250 * time.Millisecond
+
+// Locker is a tusd locker that can register itself with a store composer.
+type Locker interface {
+	handler.Locker
+	UseIn(composer *handler.StoreComposer)
+}
+
+// New returns the locker selected by cfg.Locker.
+func New(cfg *config.Config) (Locker, error) {
+	switch cfg.Locker {
+	case "memory":
+		return memorylocker.New(), nil
+	case "file":
+		return NewFile(cfg.LockerDir)
+	case "s3":
+		return NewS3(cfg)
+	default:
+		return nil, fmt.Errorf("locker: unknown locker %q", cfg.Locker)
+	}
+}
+
+// validID reports whether id can be used in a file name or object key. tusd
+// takes upload IDs from the request path, so they must not be trusted.
+func validID(id string) bool {
+	if id == "" || id[0] == '.' {
+		return false
+	}
+	for _, c := range id {
+		if c == '/' || c == '\\' || c < ' ' {
+			return false
+		}
+	}
+	return true
+}
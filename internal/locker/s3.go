@@ -0,0 +1,294 @@
+package locker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/config"
+	"sharemk/internal/s3client"
+)
+
+const (
+	// s3LeaseTTL is how long a lock object stays valid without renewal. A
+	// replica that dies while holding a lock blocks the upload for at most
+	// this long.
+	s3LeaseTTL = 30 * time.Second
+
+	// s3PollInterval replaces pollInterval for the S3 locker, where every
+	// poll is a billed request.
+	s3PollInterval = time.Second
+)
+
+// S3 locks uploads with lock objects in the bucket. Locks are created with a
+// conditional write (If-None-Match: *), so only one replica can create a
+// given lock object, and hold a lease the owner renews while the request
+// runs. A lock whose lease has run out is taken over with a write that is
+// conditional on its ETag. The provider must support conditional writes
+// (AWS S3, MinIO, Cloudflare R2 and others do).
+type S3 struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	owner  string
+}
+
+// lease is the content of a lock object.
+type lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewS3 returns a locker keeping its lock objects under cfg.LockerPrefix in
+// the upload bucket.
+func NewS3(cfg *config.Config) (*S3, error) {
+	client, err := s3client.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	owner := make([]byte, 8)
+	if _, err := rand.Read(owner); err != nil {
+		return nil, err
+	}
+	return &S3{
+		client: client,
+		bucket: cfg.S3Bucket,
+		prefix: cfg.LockerPrefix,
+		owner:  hex.EncodeToString(owner),
+	}, nil
+}
+
+// UseIn registers the locker in the composer.
+func (l *S3) UseIn(composer *handler.StoreComposer) {
+	composer.UseLocker(l)
+}
+
+func (l *S3) NewLock(id string) (handler.Lock, error) {
+	if !validID(id) {
+		return nil, handler.ErrNotFound
+	}
+	return &s3Lock{locker: l, key: l.prefix + id}, nil
+}
+
+type s3Lock struct {
+	locker *S3
+	key    string
+
+	etag string
+	lost bool
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// Lock takes the lock, asking the current holder to release it and retrying
+// until ctx is done.
+func (l *s3Lock) Lock(ctx context.Context, requestRelease func()) error {
+	for {
+		etag, err := l.acquire(ctx)
+		if ctx.Err() != nil {
+			return handler.ErrLockTimeout
+		}
+		if err != nil {
+			return err
+		}
+		if etag != "" {
+			l.etag = etag
+			break
+		}
+
+		l.putRelease(ctx)
+		select {
+		case <-ctx.Done():
+			return handler.ErrLockTimeout
+		case <-time.After(s3PollInterval):
+		}
+	}
+
+	// A release marker left from before belongs to the previous holder.
+	l.locker.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(l.locker.bucket),
+		Key:    aws.String(l.key + ".release"),
+	})
+
+	l.stop = make(chan struct{})
+	l.done.Add(1)
+	go l.hold(requestRelease)
+	return nil
+}
+
+// acquire creates the lock object or takes over an expired one. It returns
+// the lock object's ETag, or "" if the lock is held by someone else.
+func (l *s3Lock) acquire(ctx context.Context) (string, error) {
+	etag, err := l.putLease(ctx, func(in *s3.PutObjectInput) { in.IfNoneMatch = aws.String("*") })
+	if !isConflict(err) {
+		return etag, err
+	}
+
+	out, err := l.locker.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.locker.bucket),
+		Key:    aws.String(l.key),
+	})
+	if isNotFound(err) {
+		// Released in the meantime; try again on the next poll.
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var held lease
+	err = json.NewDecoder(out.Body).Decode(&held)
+	out.Body.Close()
+	if err == nil && time.Now().Before(held.Expires) {
+		return "", nil
+	}
+
+	slog.Warn("locker: taking over expired upload lock", "key", l.key, "owner", held.Owner)
+	etag, err = l.putLease(ctx, func(in *s3.PutObjectInput) { in.IfMatch = out.ETag })
+	if isConflict(err) {
+		return "", nil
+	}
+	return etag, err
+}
+
+// hold renews the lease until Unlock and calls requestRelease when another
+// replica asks for the lock or the lock has been lost.
+func (l *s3Lock) hold(requestRelease func()) {
+	defer l.done.Done()
+
+	renew := time.NewTicker(s3LeaseTTL / 3)
+	defer renew.Stop()
+	poll := time.NewTicker(s3PollInterval)
+	defer poll.Stop()
+	requested := false
+
+	for {
+		select {
+		case <-l.stop:
+			return
+
+		case <-renew.C:
+			ctx, cancel := context.WithTimeout(context.Background(), s3LeaseTTL/3)
+			etag, err := l.putLease(ctx, func(in *s3.PutObjectInput) { in.IfMatch = aws.String(l.etag) })
+			cancel()
+			if isConflict(err) || isNotFound(err) {
+				slog.Warn("locker: lost upload lock", "key", l.key)
+				l.lost = true
+				requestRelease()
+				return
+			}
+			if err != nil {
+				// The lease is still valid for a while; retry on the next tick.
+				slog.Warn("locker: failed to renew upload lock", "key", l.key, "error", err)
+				continue
+			}
+			l.etag = etag
+
+		case <-poll.C:
+			if requested {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), s3PollInterval)
+			_, err := l.locker.client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(l.locker.bucket),
+				Key:    aws.String(l.key + ".release"),
+			})
+			cancel()
+			if err == nil {
+				requested = true
+				requestRelease()
+			}
+		}
+	}
+}
+
+func (l *s3Lock) Unlock() error {
+	close(l.stop)
+	l.done.Wait()
+	if l.lost {
+		// The lock object belongs to another replica now.
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := l.locker.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(l.locker.bucket),
+		Delete: &s3types.Delete{
+			Objects: []s3types.ObjectIdentifier{
+				{Key: aws.String(l.key)},
+				{Key: aws.String(l.key + ".release")},
+			},
+			Quiet: aws.Bool(true),
+		},
+	})
+	return err
+}
+
+// putLease writes a fresh lease to the lock object, applying cond to make
+// the write conditional, and returns the new ETag.
+func (l *s3Lock) putLease(ctx context.Context, cond func(*s3.PutObjectInput)) (string, error) {
+	b, err := json.Marshal(lease{Owner: l.locker.owner, Expires: time.Now().Add(s3LeaseTTL)})
+	if err != nil {
+		return "", err
+	}
+	in := &s3.PutObjectInput{
+		Bucket:        aws.String(l.locker.bucket),
+		Key:           aws.String(l.key),
+		Body:          bytes.NewReader(b),
+		ContentLength: aws.Int64(int64(len(b))),
+		ContentType:   aws.String("application/json"),
+	}
+	cond(in)
+	out, err := l.locker.client.PutObject(ctx, in)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+// putRelease leaves a release marker asking the holder to let go.
+func (l *s3Lock) putRelease(ctx context.Context) {
+	_, err := l.locker.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(l.locker.bucket),
+		Key:           aws.String(l.key + ".release"),
+		Body:          bytes.NewReader(nil),
+		ContentLength: aws.Int64(0),
+	})
+	if err != nil && ctx.Err() == nil {
+		slog.Warn("locker: failed to request lock release", "key", l.key, "error", err)
+	}
+}
+
+// isConflict reports whether err is a failed conditional write.
+func isConflict(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
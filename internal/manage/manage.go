@@ -0,0 +1,250 @@
+// Package manage implements the operations an uploader can perform on their
+// own upload by presenting its management token. The MCP tools and the REST
+// endpoints both go through it so they authorise and behave identically.
+package manage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/config"
+	"sharemk/internal/downloads"
+	"sharemk/internal/expiry"
+	"sharemk/internal/lifetime"
+	"sharemk/internal/scan"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+	"sharemk/internal/webhook"
+)
+
+// ErrUnauthorized is returned when the upload does not exist, has no
+// management token, or the token does not match. The cases are deliberately
+// indistinguishable so callers cannot enumerate valid file IDs.
+var ErrUnauthorized = errors.New("invalid file_id or management_token")
+
+// InvalidError reports a request the caller has to correct, such as an
+// expiry outside the configured bounds.
+type InvalidError struct {
+	Err error
+}
+
+func (e *InvalidError) Error() string { return e.Err.Error() }
+func (e *InvalidError) Unwrap() error { return e.Err }
+
+// FileInfo is what an owner is told about their upload. It never includes
+// the management token itself.
+type FileInfo struct {
+	FileID            string `json:"file_id"`
+	Filename          string `json:"filename"`
+	ContentType       string `json:"content_type"`
+	SizeBytes         int64  `json:"size_bytes"`
+	DownloadURL       string `json:"download_url"`
+	ShortURL          string `json:"short_url,omitempty"`
+	ExpiresAt         string `json:"expires_at"`
+	MaxDownloads      int    `json:"max_downloads,omitempty"`
+	PasswordProtected bool   `json:"password_protected,omitempty"`
+
+	// Encrypted uploads are listed with a download URL lacking the key,
+	// which only the uploader has.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// ScanStatus is set on servers that scan uploads for malware.
+	ScanStatus    string `json:"scan_status,omitempty"`
+	ScanSignature string `json:"scan_signature,omitempty"`
+}
+
+// Collections looks up the collection an upload belongs to. It is
+// implemented by *collection.Collections, which is passed in because the
+// collection package imports this one.
+type Collections interface {
+	// MemberExpiry returns when the collection of the upload with metadata
+	// meta expires. ok is false for uploads in no collection.
+	MemberExpiry(ctx context.Context, meta map[string]string) (t time.Time, ok bool, err error)
+}
+
+type Manager struct {
+	cfg         *config.Config
+	store       storage.Backend
+	index       *expiry.Index
+	links       *shortlink.Links
+	collections Collections
+	policy      lifetime.Policy
+	notifier    *webhook.Notifier
+}
+
+func New(cfg *config.Config, store storage.Backend, collections Collections, notifier *webhook.Notifier) *Manager {
+	return &Manager{
+		cfg:         cfg,
+		store:       store,
+		index:       expiry.NewIndex(cfg, store),
+		links:       shortlink.New(cfg, store),
+		collections: collections,
+		policy:      lifetime.Policy{Min: cfg.ExpiryMin, Max: cfg.ExpiryMax, Default: cfg.ExpiryDefault},
+		notifier:    notifier,
+	}
+}
+
+// Info returns the metadata of upload id.
+func (m *Manager) Info(ctx context.Context, id, token string) (FileInfo, error) {
+	key, info, err := m.authorize(ctx, id, token)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	tags, _ := m.store.GetTags(ctx, key)
+
+	fi := FileInfo{
+		FileID:            info.ID,
+		Filename:          info.MetaData["filename"],
+		ContentType:       info.MetaData["filetype"],
+		SizeBytes:         info.Size,
+		DownloadURL:       m.DownloadURL(info.ID),
+		ExpiresAt:         tags["expires-at"],
+		PasswordProtected: info.MetaData["password-hash"] != "",
+		Encrypted:         info.MetaData["encryption"] == "sse-c",
+		ScanStatus:        info.MetaData[scan.StatusKey],
+		ScanSignature:     info.MetaData[scan.SignatureKey],
+	}
+	if n, ok := downloads.Limit(info.MetaData); ok {
+		fi.MaxDownloads = n
+	}
+	if code := info.MetaData[shortlink.MetaKey]; code != "" {
+		fi.ShortURL = m.links.URL(code)
+	}
+	return fi, nil
+}
+
+// Delete permanently removes upload id.
+func (m *Manager) Delete(ctx context.Context, id, token string) error {
+	key, info, err := m.authorize(ctx, id, token)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Delete(ctx, storage.UploadObjects(key)...); err != nil {
+		return err
+	}
+	if err := m.links.Delete(ctx, info.MetaData[shortlink.MetaKey]); err != nil {
+		slog.Warn("manage: failed to delete short link", "upload_id", id, "error", err)
+	}
+	slog.Info("manage: deleted upload", "upload_id", id)
+	m.notifier.Notify(webhook.UploadDeleted, info, time.Time{})
+	return nil
+}
+
+// DownloadURL returns the public download URL of upload id.
+func (m *Manager) DownloadURL(id string) string {
+	return strings.TrimRight(m.cfg.PublicURL, "/") + m.cfg.TUSBasePath + id
+}
+
+// UpdateExpiry moves the expiry of upload id to expiresIn from now or to the
+// absolute time expiresAt, within the same bounds that apply at upload time.
+// Uploads in a collection cannot outlast it. It re-tags the data and .info
+// objects and moves the upload's index marker.
+func (m *Manager) UpdateExpiry(ctx context.Context, id, token, expiresIn, expiresAt string) (time.Time, error) {
+	key, info, err := m.authorize(ctx, id, token)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	newTime, err := m.policy.Resolve(expiresIn, expiresAt, time.Now())
+	if err != nil {
+		return time.Time{}, &InvalidError{Err: err}
+	}
+
+	// The worker deletes a collection with the listing of its members, so a
+	// member kept longer would be left out of it.
+	colTime, member, err := m.collections.MemberExpiry(ctx, info.MetaData)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if member && newTime.After(colTime) {
+		return time.Time{}, &InvalidError{Err: fmt.Errorf("expiry must not be later than the collection's, %s", colTime.Format(time.RFC3339))}
+	}
+
+	tags, err := m.store.GetTags(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	oldTime, oldErr := time.Parse(time.RFC3339, tags["expires-at"])
+
+	// Keep the other tags, such as the short code.
+	newTags := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		newTags[k] = v
+	}
+	newTags["expires-at"] = newTime.Format(time.RFC3339)
+	for _, k := range []string{key, key + ".info"} {
+		if err := m.store.SetTags(ctx, k, newTags); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	// The worker only acts on a marker once the tag agrees, so a stale or
+	// missing marker is harmless: it is dropped on its bucket's scan and the
+	// reconciliation scan re-indexes the upload.
+	if err := m.index.Add(ctx, key, newTime); err != nil {
+		slog.Warn("manage: failed to index expiry", "key", key, "error", err)
+	}
+	if oldErr == nil && !oldTime.Equal(newTime) {
+		if err := m.index.Remove(ctx, key, oldTime); err != nil {
+			slog.Warn("manage: failed to remove old expiry marker", "key", key, "error", err)
+		}
+	}
+
+	slog.Info("manage: updated expiry", "upload_id", id, "expires_at", newTags["expires-at"])
+	return newTime, nil
+}
+
+// Authorize checks token against the management token of upload id and
+// returns the upload's info.
+func (m *Manager) Authorize(ctx context.Context, id, token string) (handler.FileInfo, error) {
+	_, info, err := m.authorize(ctx, id, token)
+	return info, err
+}
+
+// authorize loads the .info of upload id and checks token against the
+// management token stored in its metadata.
+func (m *Manager) authorize(ctx context.Context, id, token string) (string, handler.FileInfo, error) {
+	key := m.store.UploadKey(id)
+	info, err := storage.ReadInfo(ctx, m.store, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return "", handler.FileInfo{}, ErrUnauthorized
+		}
+		return "", handler.FileInfo{}, err
+	}
+	if !TokenMatches(info.MetaData["mgmt-token"], token) {
+		return "", handler.FileInfo{}, ErrUnauthorized
+	}
+	return key, info, nil
+}
+
+// GenerateToken returns a cryptographically random 32-byte token as a
+// lowercase hex string (64 characters, 256-bit entropy).
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// TokenMatches compares stored and provided tokens in constant time to
+// prevent timing-oracle attacks.  Both strings must be non-empty AND equal
+// for the function to return true.  Using crypto/subtle instead of == or
+// strings.Compare ensures the comparison time does not leak information
+// about how many characters matched.
+func TokenMatches(stored, provided string) bool {
+	if stored == "" || provided == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(provided)) == 1
+}
@@ -5,35 +5,37 @@ package mcpserver
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/subtle"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/google/uuid"
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"go.opentelemetry.io/otel/codes"
+	"sharemk/internal/collection"
 	"sharemk/internal/config"
+	"sharemk/internal/contenttype"
+	"sharemk/internal/expiry"
+	"sharemk/internal/lifetime"
+	"sharemk/internal/manage"
+	"sharemk/internal/metrics"
+	"sharemk/internal/password"
+	"sharemk/internal/scan"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+	"sharemk/internal/tracing"
+	"sharemk/internal/webhook"
 )
 
-var validExpiries = map[string]time.Duration{
-	"1h":  1 * time.Hour,
-	"6h":  6 * time.Hour,
-	"24h": 24 * time.Hour,
-	"7d":  7 * 24 * time.Hour,
-	"30d": 30 * 24 * time.Hour,
-}
-
-// fileInfo mirrors the subset of tusd's FileInfo that s3store serialises to
-// the .info object, so the tusd GET handler can serve MCP-uploaded files.
+// fileInfo mirrors the subset of tusd's FileInfo that the tusd stores
+// serialise to the .info object, so the tusd GET handler can serve
+// MCP-uploaded files.
 type fileInfo struct {
 	ID             string            `json:"ID"`
 	Size           int64             `json:"Size"`
@@ -48,29 +50,92 @@ type fileInfo struct {
 
 // MCPServer wraps an MCP server instance and holds shared dependencies.
 type MCPServer struct {
-	cfg      *config.Config
-	s3Client *s3.Client
-	mcp      *server.MCPServer
+	cfg         *config.Config
+	store       storage.Backend
+	index       *expiry.Index
+	policy      lifetime.Policy
+	types       contenttype.Policy
+	manager     *manage.Manager
+	collections *collection.Collections
+	links       *shortlink.Links
+	notifier    *webhook.Notifier
+	scanner     *scan.Scanner
+	mcp         *server.MCPServer
 }
 
 // New creates an MCPServer and registers all tools.
-func New(cfg *config.Config, s3Client *s3.Client) *MCPServer {
-	ms := &MCPServer{cfg: cfg, s3Client: s3Client}
+func New(cfg *config.Config, store storage.Backend, notifier *webhook.Notifier, scanner *scan.Scanner) *MCPServer {
+	collections := collection.New(cfg, store)
+	ms := &MCPServer{
+		cfg:         cfg,
+		store:       store,
+		index:       expiry.NewIndex(cfg, store),
+		policy:      lifetime.Policy{Min: cfg.ExpiryMin, Max: cfg.ExpiryMax, Default: cfg.ExpiryDefault},
+		types:       contenttype.Policy{Allow: cfg.ContentTypesAllow, Deny: cfg.ContentTypesDeny},
+		manager:     manage.New(cfg, store, collections, notifier),
+		collections: collections,
+		links:       shortlink.New(cfg, store),
+		notifier:    notifier,
+		scanner:     scanner,
+	}
 
 	s := server.NewMCPServer(
 		"share.mk",
 		"1.0.0",
 		server.WithToolCapabilities(false),
+		server.WithToolHandlerMiddleware(observeTool),
+		server.WithToolHandlerMiddleware(traceTool),
 	)
 
 	s.AddTool(ms.uploadFileTool(), ms.handleUploadFile)
 	s.AddTool(ms.getFileInfoTool(), ms.handleGetFileInfo)
 	s.AddTool(ms.deleteFileTool(), ms.handleDeleteFile)
+	s.AddTool(ms.updateExpiryTool(), ms.handleUpdateExpiry)
+	s.AddTool(ms.createCollectionTool(), ms.handleCreateCollection)
 
 	ms.mcp = s
 	return ms
 }
 
+// observeTool records the call count and latency of every tool call.
+func observeTool(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		start := time.Now()
+		res, err := next(ctx, req)
+
+		result := "ok"
+		if err != nil || (res != nil && res.IsError) {
+			result = "error"
+		}
+		metrics.MCPToolCalls.WithLabelValues(req.Params.Name, result).Inc()
+		metrics.MCPToolDuration.WithLabelValues(req.Params.Name).Observe(time.Since(start).Seconds())
+		return res, err
+	}
+}
+
+// traceTool wraps every tool call in a span named after the tool.
+func traceTool(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		ctx, span := tracing.Start(ctx, "mcp."+req.Params.Name)
+		res, err := next(ctx, req)
+		if err == nil && res != nil && res.IsError {
+			span.SetStatus(codes.Error, toolErrorText(res))
+		}
+		tracing.End(span, err)
+		return res, err
+	}
+}
+
+// toolErrorText returns the message of a tool error result.
+func toolErrorText(res *mcp.CallToolResult) string {
+	for _, c := range res.Content {
+		if t, ok := c.(mcp.TextContent); ok {
+			return t.Text
+		}
+	}
+	return "tool error"
+}
+
 // Handler returns an http.Handler for the MCP Streamable HTTP transport.
 func (ms *MCPServer) Handler() http.Handler {
 	return server.NewStreamableHTTPServer(ms.mcp)
@@ -85,7 +150,8 @@ func (ms *MCPServer) uploadFileTool() mcp.Tool {
 		mcp.WithDescription(
 			"Upload a file to share.mk and get back a download URL. "+
 				"The file content must be base64-encoded. "+
-				"Practical size limit for MCP calls is ~10 MB.",
+				"Practical size limit for MCP calls is ~10 MB. "+
+				"If the server scans uploads for malware, the result includes the scan_status and infected files are rejected.",
 		),
 		mcp.WithString("filename",
 			mcp.Required(),
@@ -99,7 +165,56 @@ func (ms *MCPServer) uploadFileTool() mcp.Tool {
 			mcp.Description("MIME type, e.g. application/pdf. Defaults to application/octet-stream."),
 		),
 		mcp.WithString("expires_in",
-			mcp.Description("How long until the file is deleted. One of: 1h, 6h, 24h (default), 7d, 30d."),
+			mcp.Description("How long until the file is deleted, as a duration such as 90m, 72h, 3d or P2W. "+
+				"Defaults to "+lifetime.Format(ms.policy.Default)+"; must be between "+
+				lifetime.Format(ms.policy.Min)+" and "+lifetime.Format(ms.policy.Max)+"."),
+		),
+		mcp.WithString("expires_at",
+			mcp.Description("Absolute RFC 3339 deletion time, e.g. 2026-10-19T17:00:00Z. Use instead of expires_in."),
+		),
+		mcp.WithNumber("max_downloads",
+			mcp.Description("Delete the file after it has been downloaded this many times. Use 1 for burn-after-reading. Unlimited if omitted."),
+			mcp.Min(1),
+		),
+		mcp.WithString("password",
+			mcp.Description("Require this password to download the file. Recipients send it in an X-Share-Password header or via the browser form."),
+		),
+		mcp.WithBoolean("encrypt",
+			mcp.Description("Encrypt the stored file with a per-upload key (SSE-C), returned once as encryption_key and in the #fragment of the download_url. Only available if the server enables it."),
+		),
+		mcp.WithString("collection_id",
+			mcp.Description("Add the file to this collection, created with create_collection. "+
+				"The file then expires with the collection; expires_in, expires_at, max_downloads, password and encrypt cannot be used."),
+		),
+		mcp.WithString("collection_token",
+			mcp.Description("The collection_token returned by create_collection. Required with collection_id."),
+		),
+		mcp.WithString("path",
+			mcp.Description("Relative path of the file within the collection, e.g. logs/app.log, to show the collection as a folder tree. Defaults to the filename."),
+		),
+		mcp.WithString("slug",
+			mcp.Description("Custom code for the short_url, e.g. q3-report: 3 to 64 letters, digits, - or _. A random code is used if omitted. Only available if the server enables it."),
+		),
+	)
+}
+
+func (ms *MCPServer) createCollectionTool() mcp.Tool {
+	return mcp.NewTool("create_collection",
+		mcp.WithDescription(
+			"Create a collection to share several files behind one link. "+
+				"Pass the returned collection_id and collection_token to upload_file for each file. "+
+				"Recipients open the url to list the files, or download zip_url to get all of them in one zip archive.",
+		),
+		mcp.WithString("name",
+			mcp.Description("Name shown to recipients and used for the zip file, e.g. incident-4711"),
+		),
+		mcp.WithString("expires_in",
+			mcp.Description("How long until the collection and its files are deleted, as a duration such as 90m, 72h, 3d or P2W. "+
+				"Defaults to "+lifetime.Format(ms.policy.Default)+"; must be between "+
+				lifetime.Format(ms.policy.Min)+" and "+lifetime.Format(ms.policy.Max)+"."),
+		),
+		mcp.WithString("expires_at",
+			mcp.Description("Absolute RFC 3339 deletion time, e.g. 2026-10-19T17:00:00Z. Use instead of expires_in."),
 		),
 	)
 }
@@ -138,6 +253,31 @@ func (ms *MCPServer) deleteFileTool() mcp.Tool {
 	)
 }
 
+func (ms *MCPServer) updateExpiryTool() mcp.Tool {
+	return mcp.NewTool("update_expiry",
+		mcp.WithDescription(
+			"Extend or shorten the lifetime of an uploaded file. "+
+				"A file in a collection cannot be kept past the collection's expiry. "+
+				"Requires the management_token returned by upload_file.",
+		),
+		mcp.WithString("file_id",
+			mcp.Required(),
+			mcp.Description("The file ID returned by upload_file"),
+		),
+		mcp.WithString("management_token",
+			mcp.Required(),
+			mcp.Description("The management token returned by upload_file — proves ownership"),
+		),
+		mcp.WithString("expires_in",
+			mcp.Description("New lifetime measured from now, e.g. 72h, 3d or P2W. Must be between "+
+				lifetime.Format(ms.policy.Min)+" and "+lifetime.Format(ms.policy.Max)+"."),
+		),
+		mcp.WithString("expires_at",
+			mcp.Description("New absolute RFC 3339 deletion time. Use instead of expires_in."),
+		),
+	)
+}
+
 // ---------------------------------------------------------------------------
 // Tool handlers
 // ---------------------------------------------------------------------------
@@ -164,19 +304,66 @@ func (ms *MCPServer) handleUploadFile(ctx context.Context, req mcp.CallToolReque
 		}
 	}
 
+	// Both the declared type and the type the content actually has must be
+	// accepted.
 	contentType, _ := args["content_type"].(string)
+	detected := contenttype.Detect(data, filename)
+	for _, t := range []string{contentType, detected} {
+		if t == "" {
+			continue
+		}
+		if err := ms.types.Check(t); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+	}
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
 
 	expiresIn, _ := args["expires_in"].(string)
-	if expiresIn == "" {
-		expiresIn = "24h"
+	expiresAtArg, _ := args["expires_at"].(string)
+
+	// Files in a collection expire with it, and anyone with its link can
+	// download them, so they cannot have restrictions of their own.
+	collectionID, _ := args["collection_id"].(string)
+	filePath, _ := args["path"].(string)
+	if filePath != "" {
+		if collectionID == "" {
+			return mcp.NewToolResultError("path can only be used with collection_id"), nil
+		}
+		if filePath, err = collection.CleanPath(filePath); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+	}
+	if collectionID != "" {
+		for _, k := range []string{"expires_in", "expires_at", "max_downloads", "password", "encrypt"} {
+			if v, set := args[k]; set && v != nil && v != "" && v != false {
+				return mcp.NewToolResultError(k + " cannot be used with collection_id"), nil
+			}
+		}
+		if ms.cfg.S3SSEC == "always" {
+			return mcp.NewToolResultError("collections are not available on this server because every upload is encrypted"), nil
+		}
+		token, _ := args["collection_token"].(string)
+		col, err := ms.collections.Authorize(ctx, collectionID, token)
+		if err != nil {
+			return collectionError("upload_file", collectionID, err), nil
+		}
+		expiresAtArg = col.ExpiresAt.Format(time.RFC3339)
 	}
 
-	dur, ok := validExpiries[expiresIn]
-	if !ok {
-		return mcp.NewToolResultError("expires_in must be one of: 1h, 6h, 24h, 7d, 30d"), nil
+	expiresTime, err := ms.policy.Resolve(expiresIn, expiresAtArg, time.Now())
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	maxDownloads := 0
+	if v, ok := args["max_downloads"]; ok && v != nil {
+		n, isNum := v.(float64)
+		if !isNum || n < 1 || n != float64(int(n)) {
+			return mcp.NewToolResultError("max_downloads must be a positive integer"), nil
+		}
+		maxDownloads = int(n)
 	}
 
 	objectId := uuid.New().String()
@@ -185,33 +372,66 @@ func (ms *MCPServer) handleUploadFile(ctx context.Context, req mcp.CallToolReque
 	// in an empty multipartId and an immediate ErrNotFound.  Appending
 	// "+mcp" satisfies the check while clearly marking MCP-originated files.
 	tusID := objectId + "+mcp"
-	key := ms.cfg.S3ObjectPrefix + objectId
-	expiresAt := time.Now().UTC().Add(dur).Format(time.RFC3339)
+	key := ms.store.UploadKey(tusID)
+	expiresAt := expiresTime.Format(time.RFC3339)
+
+	var passwordHash string
+	if pw, _ := args["password"].(string); pw != "" {
+		passwordHash, err = password.Hash(pw)
+		if err != nil {
+			slog.Error("mcp: upload_file failed to hash password", "error", err)
+			return mcp.NewToolResultError("internal error hashing password"), nil
+		}
+	}
+
+	// A per-upload SSE-C key is kept only in the returned download URL.
+	encrypt, _ := args["encrypt"].(bool)
+	var encKey []byte
+	switch {
+	case ms.cfg.S3SSEC == "always" || (ms.cfg.S3SSEC == "optional" && encrypt):
+		encKey, err = storage.NewEncryptionKey()
+		if err != nil {
+			slog.Error("mcp: upload_file failed to generate encryption key", "error", err)
+			return mcp.NewToolResultError("internal error generating encryption key"), nil
+		}
+	case encrypt:
+		return mcp.NewToolResultError("encryption is not enabled on this server"), nil
+	}
 
 	// Generate a cryptographically random management token (256-bit entropy).
 	// This is the only mechanism that proves upload ownership for the
 	// get_file_info and delete_file tools.  It is returned once here and
 	// never exposed again — not even by get_file_info.
-	mgmtToken, err := generateToken()
+	mgmtToken, err := manage.GenerateToken()
 	if err != nil {
 		slog.Error("mcp: upload_file failed to generate management token", "error", err)
 		return mcp.NewToolResultError("internal error generating management token"), nil
 	}
 
-	opCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	// Finish the upload even if the client goes away, but stay in its trace.
+	opCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Minute)
 	defer cancel()
 
+	slug, _ := args["slug"].(string)
+	code, err := ms.links.Create(opCtx, slug, tusID)
+	switch {
+	case errors.Is(err, shortlink.ErrTaken), errors.Is(err, shortlink.ErrInvalidSlug), errors.Is(err, shortlink.ErrSlugsDisabled):
+		return mcp.NewToolResultError(err.Error()), nil
+	case err != nil:
+		slog.Error("mcp: upload_file failed to create short link", "error", err)
+		return mcp.NewToolResultError("internal error creating short link"), nil
+	}
+
 	// Upload the file data.
 	size := int64(len(data))
-	_, err = ms.s3Client.PutObject(opCtx, &s3.PutObjectInput{
-		Bucket:        aws.String(ms.cfg.S3Bucket),
-		Key:           aws.String(key),
-		Body:          bytes.NewReader(data),
-		ContentType:   aws.String(contentType),
-		ContentLength: aws.Int64(size),
-	})
+	putCtx := opCtx
+	if encKey != nil {
+		putCtx = storage.WithEncryptionKey(opCtx, encKey)
+	}
+	err = ms.store.Put(putCtx, key, bytes.NewReader(data), size, contentType)
 	if err != nil {
 		slog.Error("mcp: upload_file PutObject failed", "error", err)
+		ms.links.Delete(opCtx, code) //nolint:errcheck
 		return mcp.NewToolResultError("failed to upload file: " + err.Error()), nil
 	}
 
@@ -224,130 +444,173 @@ func (ms *MCPServer) handleUploadFile(ctx context.Context, req mcp.CallToolReque
 		Size:   size,
 		Offset: size,
 		MetaData: map[string]string{
-			"filename":   filename,
-			"filetype":   contentType,
-			"expires-in": expiresIn,
+			"filename":          filename,
+			"filetype":          contentType,
+			contenttype.MetaKey: detected,
 			// mgmt-token is stored server-side only and never returned by
 			// any endpoint except this upload response.
-			"mgmt-token": mgmtToken,
-		},
-		Storage: map[string]string{
-			"Type":   "s3store",
-			"Bucket": ms.cfg.S3Bucket,
-			"Key":    key,
+			"mgmt-token":      mgmtToken,
+			shortlink.MetaKey: code,
 		},
+		Storage: ms.store.StorageInfo(key),
+	}
+	switch {
+	case expiresAtArg != "":
+		info.MetaData["expires-at"] = expiresAtArg
+	case expiresIn != "":
+		info.MetaData["expires-in"] = expiresIn
+	default:
+		info.MetaData["expires-in"] = lifetime.Format(ms.policy.Default)
+	}
+	if maxDownloads > 0 {
+		info.MetaData["max-downloads"] = strconv.Itoa(maxDownloads)
+	}
+	if passwordHash != "" {
+		info.MetaData["password-hash"] = passwordHash
+	}
+	if encKey != nil {
+		info.MetaData["encryption"] = "sse-c"
+		info.MetaData["encryption-key-hash"] = storage.EncryptionKeyHash(encKey)
+	}
+	if collectionID != "" {
+		info.MetaData[collection.IDKey] = collectionID
+	}
+	if filePath != "" {
+		info.MetaData[collection.PathKey] = filePath
 	}
+	ms.scanner.Prepare(info.MetaData)
 	infoJSON, _ := json.Marshal(info)
 
-	_, err = ms.s3Client.PutObject(opCtx, &s3.PutObjectInput{
-		Bucket:      aws.String(ms.cfg.S3Bucket),
-		Key:         aws.String(key + ".info"),
-		Body:        bytes.NewReader(infoJSON),
-		ContentType: aws.String("application/json"),
-	})
+	err = ms.store.Put(opCtx, key+".info", bytes.NewReader(infoJSON), int64(len(infoJSON)), "application/json")
 	if err != nil {
 		slog.Error("mcp: upload_file PutObject(.info) failed", "error", err)
-		// Best-effort cleanup of the data object.
-		ms.s3Client.DeleteObject(opCtx, &s3.DeleteObjectInput{ //nolint:errcheck
-			Bucket: aws.String(ms.cfg.S3Bucket),
-			Key:    aws.String(key),
-		})
+		// Best-effort cleanup of the data object and the link.
+		ms.store.Delete(opCtx, key)  //nolint:errcheck
+		ms.links.Delete(opCtx, code) //nolint:errcheck
 		return mcp.NewToolResultError("failed to write upload metadata: " + err.Error()), nil
 	}
 
-	// Tag both objects with the expiry timestamp.
-	tags := &s3types.Tagging{
-		TagSet: []s3types.Tag{
-			{Key: aws.String("expires-at"), Value: aws.String(expiresAt)},
-		},
-	}
+	metrics.UploadsCreated.WithLabelValues(metrics.SourceMCP).Inc()
+	metrics.UploadsCompleted.WithLabelValues(metrics.SourceMCP).Inc()
+	metrics.BytesReceived.WithLabelValues(metrics.SourceMCP).Add(float64(size))
+
+	// Tag both objects with the expiry timestamp and the short code, so the
+	// expiry worker deletes the link along with them.
+	tags := map[string]string{"expires-at": expiresAt, shortlink.MetaKey: code}
 	for _, k := range []string{key, key + ".info"} {
-		if _, terr := ms.s3Client.PutObjectTagging(opCtx, &s3.PutObjectTaggingInput{
-			Bucket:  aws.String(ms.cfg.S3Bucket),
-			Key:     aws.String(k),
-			Tagging: tags,
-		}); terr != nil {
+		if terr := ms.store.SetTags(opCtx, k, tags); terr != nil {
 			slog.Warn("mcp: failed to tag object", "key", k, "error", terr)
 		}
 	}
+	if ierr := ms.index.Add(opCtx, key, expiresTime); ierr != nil {
+		slog.Warn("mcp: failed to index expiry", "key", key, "error", ierr)
+	}
+	if collectionID != "" {
+		if cerr := ms.collections.Add(opCtx, collectionID, tusID); cerr != nil {
+			slog.Error("mcp: failed to add upload to collection", "upload_id", tusID, "collection_id", collectionID, "error", cerr)
+		}
+	}
 
-	downloadURL := strings.TrimRight(ms.cfg.PublicURL, "/") + ms.cfg.TUSBasePath + tusID
+	// Scan before answering, so the caller learns the verdict.
+	uploaded := handler.FileInfo{ID: tusID, Size: size, Offset: size, MetaData: info.MetaData}
+	uploaded = ms.scanner.Scan(putCtx, key, uploaded)
+
+	// The upload is created and completed in one step.
+	ms.notifier.Notify(webhook.UploadCreated, uploaded, expiresTime)
+	ms.notifier.Notify(webhook.UploadCompleted, uploaded, expiresTime)
+
+	if uploaded.MetaData[scan.StatusKey] == scan.StatusInfected {
+		return mcp.NewToolResultError("file rejected: malware detected (" + uploaded.MetaData[scan.SignatureKey] + ")"), nil
+	}
+
+	downloadURL := ms.manager.DownloadURL(tusID)
+	shortURL := ms.links.URL(code)
+	if encKey != nil {
+		downloadURL += "#key=" + storage.EncodeEncryptionKey(encKey)
+		shortURL += "#key=" + storage.EncodeEncryptionKey(encKey)
+	}
 
 	result := map[string]any{
 		"file_id":          tusID,
 		"management_token": mgmtToken,
 		"download_url":     downloadURL,
+		"short_url":        shortURL,
 		"expires_at":       expiresAt,
 		"filename":         filename,
 		"size_bytes":       size,
+		"detected_type":    detected,
+	}
+	if maxDownloads > 0 {
+		result["max_downloads"] = maxDownloads
+	}
+	if passwordHash != "" {
+		result["password_protected"] = true
+	}
+	if encKey != nil {
+		result["encrypted"] = true
+		result["encryption_key"] = storage.EncodeEncryptionKey(encKey)
+	}
+	if status := uploaded.MetaData[scan.StatusKey]; status != "" {
+		result["scan_status"] = status
+	}
+	if collectionID != "" {
+		result["collection_id"] = collectionID
 	}
 	return toolResultJSON(result)
 }
 
-func (ms *MCPServer) handleGetFileInfo(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+func (ms *MCPServer) handleCreateCollection(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	args := req.GetArguments()
 
-	id, _ := args["file_id"].(string)
-	if id == "" {
-		return mcp.NewToolResultError("file_id is required"), nil
+	if ms.cfg.S3SSEC == "always" {
+		return mcp.NewToolResultError("collections are not available on this server because every upload is encrypted"), nil
 	}
 
-	providedToken, _ := args["management_token"].(string)
+	name, _ := args["name"].(string)
+	expiresIn, _ := args["expires_in"].(string)
+	expiresAt, _ := args["expires_at"].(string)
 
-	key := ms.objectKey(id)
-	opCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	opCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
 	defer cancel()
 
-	// Read the .info file.  Use the same error for "not found" and "wrong
-	// token" to prevent callers from enumerating valid file IDs.
-	out, err := ms.s3Client.GetObject(opCtx, &s3.GetObjectInput{
-		Bucket: aws.String(ms.cfg.S3Bucket),
-		Key:    aws.String(key + ".info"),
-	})
+	col, err := ms.collections.Create(opCtx, name, expiresIn, expiresAt)
 	if err != nil {
-		return mcp.NewToolResultError("invalid file_id or management_token"), nil
+		return manageError("create_collection", "", err), nil
 	}
-	defer out.Body.Close()
 
-	var info fileInfo
-	if err := json.NewDecoder(out.Body).Decode(&info); err != nil {
-		return mcp.NewToolResultError("invalid file_id or management_token"), nil
+	result := map[string]any{
+		"collection_id":    col.ID,
+		"collection_token": col.Token,
+		"url":              ms.collections.URL(col.ID),
+		"zip_url":          ms.collections.URL(col.ID) + ".zip",
+		"expires_at":       col.ExpiresAt.Format(time.RFC3339),
 	}
-
-	// Constant-time comparison prevents timing-oracle attacks on the token.
-	// Same error whether the file doesn't exist, has no token, or the token
-	// doesn't match.
-	if !tokenMatches(info.MetaData["mgmt-token"], providedToken) {
-		return mcp.NewToolResultError("invalid file_id or management_token"), nil
+	if col.Name != "" {
+		result["name"] = col.Name
 	}
+	return toolResultJSON(result)
+}
 
-	// Read expiry tag.
-	tagsOut, _ := ms.s3Client.GetObjectTagging(opCtx, &s3.GetObjectTaggingInput{
-		Bucket: aws.String(ms.cfg.S3Bucket),
-		Key:    aws.String(key),
-	})
-	expiresAt := ""
-	if tagsOut != nil {
-		for _, t := range tagsOut.TagSet {
-			if aws.ToString(t.Key) == "expires-at" {
-				expiresAt = aws.ToString(t.Value)
-				break
-			}
-		}
+func (ms *MCPServer) handleGetFileInfo(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	args := req.GetArguments()
+
+	id, _ := args["file_id"].(string)
+	if id == "" {
+		return mcp.NewToolResultError("file_id is required"), nil
 	}
 
-	downloadURL := strings.TrimRight(ms.cfg.PublicURL, "/") + ms.cfg.TUSBasePath + info.ID
+	providedToken, _ := args["management_token"].(string)
 
-	// Never return the stored mgmt-token in responses.
-	result := map[string]any{
-		"file_id":      info.ID,
-		"filename":     info.MetaData["filename"],
-		"content_type": info.MetaData["filetype"],
-		"size_bytes":   info.Size,
-		"download_url": downloadURL,
-		"expires_at":   expiresAt,
+	opCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+
+	// The same error is returned for "not found" and "wrong token" to
+	// prevent callers from enumerating valid file IDs.
+	info, err := ms.manager.Info(opCtx, id, providedToken)
+	if err != nil {
+		return manageError("get_file_info", id, err), nil
 	}
-	return toolResultJSON(result)
+	return toolResultJSON(info)
 }
 
 func (ms *MCPServer) handleDeleteFile(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -360,82 +623,69 @@ func (ms *MCPServer) handleDeleteFile(ctx context.Context, req mcp.CallToolReque
 
 	providedToken, _ := args["management_token"].(string)
 
-	key := ms.objectKey(id)
-	opCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	opCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
 	defer cancel()
 
-	// Verify ownership before deleting.  Read the .info file to get the
-	// stored token.  Same error for "not found" vs "wrong token" to prevent
-	// file-ID enumeration via the delete endpoint.
-	out, err := ms.s3Client.GetObject(opCtx, &s3.GetObjectInput{
-		Bucket: aws.String(ms.cfg.S3Bucket),
-		Key:    aws.String(key + ".info"),
-	})
-	if err != nil {
-		return mcp.NewToolResultError("invalid file_id or management_token"), nil
+	if err := ms.manager.Delete(opCtx, id, providedToken); err != nil {
+		return manageError("delete_file", id, err), nil
 	}
-	defer out.Body.Close()
 
-	var info fileInfo
-	if err := json.NewDecoder(out.Body).Decode(&info); err != nil {
-		return mcp.NewToolResultError("invalid file_id or management_token"), nil
+	return toolResultJSON(map[string]any{"deleted": true, "file_id": id})
+}
+
+func (ms *MCPServer) handleUpdateExpiry(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	args := req.GetArguments()
+
+	id, _ := args["file_id"].(string)
+	if id == "" {
+		return mcp.NewToolResultError("file_id is required"), nil
 	}
 
-	if !tokenMatches(info.MetaData["mgmt-token"], providedToken) {
-		return mcp.NewToolResultError("invalid file_id or management_token"), nil
+	providedToken, _ := args["management_token"].(string)
+	expiresIn, _ := args["expires_in"].(string)
+	expiresAt, _ := args["expires_at"].(string)
+	if expiresIn == "" && expiresAt == "" {
+		return mcp.NewToolResultError("expires_in or expires_at is required"), nil
 	}
 
-	_, err = ms.s3Client.DeleteObjects(opCtx, &s3.DeleteObjectsInput{
-		Bucket: aws.String(ms.cfg.S3Bucket),
-		Delete: &s3types.Delete{
-			Objects: []s3types.ObjectIdentifier{
-				{Key: aws.String(key)},
-				{Key: aws.String(key + ".info")},
-			},
-			Quiet: aws.Bool(true),
-		},
-	})
+	opCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+
+	expiresTime, err := ms.manager.UpdateExpiry(opCtx, id, providedToken, expiresIn, expiresAt)
 	if err != nil {
-		return mcp.NewToolResultError("failed to delete file: " + err.Error()), nil
+		return manageError("update_expiry", id, err), nil
 	}
 
-	return toolResultJSON(map[string]any{"deleted": true, "file_id": id})
+	return toolResultJSON(map[string]any{
+		"file_id":    id,
+		"expires_at": expiresTime.Format(time.RFC3339),
+	})
 }
 
 // ---------------------------------------------------------------------------
 // Helpers
 // ---------------------------------------------------------------------------
 
-// generateToken returns a cryptographically random 32-byte token as a
-// lowercase hex string (64 characters, 256-bit entropy).
-func generateToken() (string, error) {
-	b := make([]byte, 32)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(b), nil
-}
-
-// tokenMatches compares stored and provided tokens in constant time to
-// prevent timing-oracle attacks.  Both strings must be non-empty AND equal
-// for the function to return true.  Using crypto/subtle instead of == or
-// strings.Compare ensures the comparison time does not leak information
-// about how many characters matched.
-func tokenMatches(stored, provided string) bool {
-	if stored == "" || provided == "" {
-		return false
+// manageError turns an error from the manage package into a tool error.
+// Authorization and input errors are passed through verbatim; anything else
+// is logged.
+func manageError(tool, id string, err error) *mcp.CallToolResult {
+	var invalid *manage.InvalidError
+	if errors.Is(err, manage.ErrUnauthorized) || errors.As(err, &invalid) {
+		return mcp.NewToolResultError(err.Error())
 	}
-	return subtle.ConstantTimeCompare([]byte(stored), []byte(provided)) == 1
+	slog.Error("mcp: "+tool+" failed", "file_id", id, "error", err)
+	return mcp.NewToolResultError(tool + " failed: " + err.Error())
 }
 
-// objectKey converts a tus upload ID (possibly in "objectId+multipartId"
-// format) to the S3 object key for the data file.
-func (ms *MCPServer) objectKey(id string) string {
-	objectId := id
-	if i := strings.IndexByte(id, '+'); i >= 0 {
-		objectId = id[:i]
+// collectionError turns an error from the collection package into a tool
+// error, like manageError.
+func collectionError(tool, id string, err error) *mcp.CallToolResult {
+	if errors.Is(err, collection.ErrUnauthorized) {
+		return mcp.NewToolResultError(err.Error())
 	}
-	return ms.cfg.S3ObjectPrefix + objectId
+	slog.Error("mcp: "+tool+" failed", "collection_id", id, "error", err)
+	return mcp.NewToolResultError(tool + " failed: " + err.Error())
 }
 
 func toolResultJSON(v any) (*mcp.CallToolResult, error) {
@@ -0,0 +1,167 @@
+// Package metrics defines the Prometheus metrics exported on GET /metrics.
+//
+// Collectors are package-level so the packages they describe can update
+// them directly. tusd's own collector (tusd_* metrics) is registered
+// alongside them in main.
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sharemk"
+
+// Sources of uploads, used as the "source" label.
+const (
+	SourceTus = "tus"
+	SourceMCP = "mcp"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	UploadsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_created_total",
+		Help:      "Uploads created, by source (tus or mcp).",
+	}, []string{"source"})
+
+	UploadsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_completed_total",
+		Help:      "Uploads whose data has been fully received, by source.",
+	}, []string{"source"})
+
+	BytesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_received_total",
+		Help:      "Upload bytes received, by source.",
+	}, []string{"source"})
+
+	Downloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloads_total",
+		Help:      "Successful file downloads.",
+	})
+
+	BytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_bytes_served_total",
+		Help:      "File bytes sent to downloaders.",
+	})
+
+	DownloadRedirects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_redirects_total",
+		Help:      "Downloads redirected to a presigned S3 URL.",
+	})
+
+	ZipDownloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "collection_zip_downloads_total",
+		Help:      "Collections downloaded as a zip archive.",
+	})
+
+	RateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Upload requests rejected with 429 by the concurrency limiter.",
+	})
+
+	Scans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scans_total",
+		Help:      "Completed uploads checked by the malware scanner, by status.",
+	}, []string{"status"})
+
+	ExpiryRunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "expiry_run_duration_seconds",
+		Help:      "Duration of expiry worker runs, by run (sweep or reconcile).",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600},
+	}, []string{"run"})
+
+	ExpiryDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "expiry_deleted_uploads_total",
+		Help:      "Expired uploads deleted by the expiry worker, by run.",
+	}, []string{"run"})
+
+	MCPToolCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mcp_tool_calls_total",
+		Help:      "MCP tool calls, by tool and result (ok or error).",
+	}, []string{"tool", "result"})
+
+	MCPToolDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mcp_tool_duration_seconds",
+		Help:      "MCP tool call latency, by tool.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"tool"})
+
+	S3Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_errors_total",
+		Help:      "Failed S3 API calls, by operation and error code. NotFound and NoSuchKey are part of normal operation.",
+	}, []string{"operation", "code"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		UploadsCreated,
+		UploadsCompleted,
+		BytesReceived,
+		Downloads,
+		BytesServed,
+		DownloadRedirects,
+		ZipDownloads,
+		RateLimited,
+		Scans,
+		ExpiryRunDuration,
+		ExpiryDeleted,
+		MCPToolCalls,
+		MCPToolDuration,
+		S3Errors,
+	)
+}
+
+// Register adds collectors that are built at startup, such as tusd's.
+func Register(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
+// ActiveUploads returns a gauge reporting the uploads currently holding a
+// slot of the concurrency limiter, as returned by active.
+func ActiveUploads(active func() int) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_uploads",
+		Help:      "Upload requests in progress, as counted by the concurrency limiter.",
+	}, func() float64 { return float64(active()) })
+}
+
+// Handler serves the metrics in the Prometheus text format. If token is not
+// empty, scrapers must send it as a bearer token.
+func Handler(token string) http.Handler {
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
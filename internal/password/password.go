@@ -0,0 +1,92 @@
+// Package password hashes and verifies download passwords with argon2id.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Parameters follow the RFC 9106 second recommended option, scaled so that a
+// verification stays well under 100 ms on a small VPS.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 2
+	argonKeyLen  = 32
+	saltLen      = 16
+)
+
+// maxConcurrent bounds the hashes computed at once. Each takes argonMemory
+// KiB, so a burst of uploads or wrong guesses could otherwise exhaust the
+// server's memory; the rest wait their turn.
+const maxConcurrent = 4
+
+var slots = make(chan struct{}, maxConcurrent)
+
+var errMalformed = errors.New("password: malformed hash")
+
+// idKey computes an argon2id key, waiting for a free slot first.
+func idKey(pw, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	slots <- struct{}{}
+	defer func() { <-slots }()
+	return argon2.IDKey(pw, salt, time, memory, threads, keyLen)
+}
+
+// Hash returns the PHC-formatted argon2id hash of pw, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>".
+func Hash(pw string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := idKey([]byte(pw), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether pw matches a hash produced by Hash. Malformed hashes
+// never match.
+func Verify(hash, pw string) bool {
+	ok, err := verify(hash, pw)
+	return err == nil && ok
+}
+
+func verify(hash, pw string) (bool, error) {
+	// "", "argon2id", "v=19", "m=…,t=…,p=…", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errMalformed
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errMalformed
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errMalformed
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errMalformed
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, errMalformed
+	}
+
+	got := idKey([]byte(pw), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
@@ -0,0 +1,67 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashVerify(t *testing.T) {
+	hash, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Errorf("Hash = %q, want a PHC-formatted argon2id hash", hash)
+	}
+	if other, _ := Hash("correct horse"); other == hash {
+		t.Error("two hashes of the same password are equal; the salt is not random")
+	}
+
+	tests := []struct {
+		name string
+		pw   string
+		want bool
+	}{
+		{"correct", "correct horse", true},
+		{"wrong", "battery staple", false},
+		{"case differs", "Correct horse", false},
+		{"prefix", "correct", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Verify(hash, tt.pw); got != tt.want {
+				t.Errorf("Verify(hash, %q) = %v, want %v", tt.pw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	hash, err := Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"plain text", "secret"},
+		{"other algorithm", strings.Replace(hash, "argon2id", "argon2i", 1)},
+		{"other version", strings.Replace(hash, "v=19", "v=16", 1)},
+		{"bad parameters", strings.Replace(hash, "m=65536,t=3,p=2", "m=x", 1)},
+		{"bad salt", strings.Join([]string{"", parts[1], parts[2], parts[3], "!!", parts[5]}, "$")},
+		{"no key", strings.Join([]string{"", parts[1], parts[2], parts[3], parts[4], ""}, "$")},
+		{"missing part", strings.Join(parts[:5], "$")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if Verify(tt.hash, "secret") {
+				t.Errorf("Verify(%q, %q) = true, want false", tt.hash, "secret")
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Failures limits repeated failed attempts per key, e.g. wrong download
+// passwords per file. Once a key has recorded max failures inside window it
+// is blocked until the oldest of them falls out of the window.
+type Failures struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	attempts map[string][]time.Time
+	lastGC   time.Time
+}
+
+func NewFailures(maxFailures int, window time.Duration) *Failures {
+	return &Failures{
+		max:      maxFailures,
+		window:   window,
+		attempts: make(map[string][]time.Time),
+	}
+}
+
+// Allowed reports whether key may make another attempt. A limit of zero or
+// less disables the check.
+func (f *Failures) Allowed(key string) bool {
+	if f.max <= 0 {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.recent(key, time.Now())) < f.max
+}
+
+// Reserve records an attempt for key as failed before it is made, and
+// reports whether key was allowed to make it. Checking and recording in one
+// step means concurrent attempts cannot all pass while the first ones are
+// still being checked. Call Reset if the attempt succeeds.
+func (f *Failures) Reserve(key string) bool {
+	if f.max <= 0 {
+		return true
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recent := f.recent(key, now)
+	if len(recent) >= f.max {
+		return false
+	}
+	f.attempts[key] = append(recent, now)
+	f.gc(now)
+	return true
+}
+
+// Reset forgets all failures recorded for key, including reserved ones.
+func (f *Failures) Reset(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.attempts, key)
+}
+
+// recent drops attempts older than the window and returns the rest.
+// f.mu must be held.
+func (f *Failures) recent(key string, now time.Time) []time.Time {
+	ts := f.attempts[key]
+	i := 0
+	for i < len(ts) && now.Sub(ts[i]) >= f.window {
+		i++
+	}
+	ts = ts[i:]
+	if len(ts) == 0 {
+		delete(f.attempts, key)
+		return nil
+	}
+	f.attempts[key] = ts
+	return ts
+}
+
+// gc periodically removes keys whose attempts have all expired so the map
+// does not grow without bound. f.mu must be held.
+func (f *Failures) gc(now time.Time) {
+	if now.Sub(f.lastGC) < f.window {
+		return
+	}
+	f.lastGC = now
+	for key := range f.attempts {
+		f.recent(key, now)
+	}
+}
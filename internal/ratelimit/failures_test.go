@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFailuresReserve(t *testing.T) {
+	f := NewFailures(3, time.Minute)
+	for i := range 3 {
+		if !f.Reserve("a") {
+			t.Fatalf("attempt %d refused, want allowed", i+1)
+		}
+	}
+	if f.Reserve("a") {
+		t.Error("fourth attempt allowed, want refused")
+	}
+	if f.Allowed("a") {
+		t.Error("Allowed after three failures, want false")
+	}
+	if !f.Reserve("b") {
+		t.Error("other key refused")
+	}
+
+	f.Reset("a")
+	if !f.Reserve("a") {
+		t.Error("attempt after Reset refused")
+	}
+}
+
+func TestFailuresReserveConcurrent(t *testing.T) {
+	f := NewFailures(5, time.Minute)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if f.Reserve("a") {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 5 {
+		t.Errorf("%d concurrent attempts allowed, want 5", allowed)
+	}
+}
+
+func TestFailuresDisabled(t *testing.T) {
+	f := NewFailures(0, time.Minute)
+	for range 10 {
+		if !f.Reserve("a") {
+			t.Fatal("attempt refused with the limit disabled")
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package ratelimit
 
 import (
-	"net"
+	"log/slog"
 	"net/http"
-	"strings"
 	"sync"
+
+	"sharemk/internal/clientip"
+	"sharemk/internal/metrics"
 )
 
 type Limiter struct {
@@ -54,6 +56,11 @@ func (l *Limiter) release(ip string) {
 	}
 }
 
+// Active returns the number of upload requests currently holding a slot.
+func (l *Limiter) Active() int {
+	return len(l.globalSem)
+}
+
 func (l *Limiter) ipChan(ip string) chan struct{} {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -65,16 +72,20 @@ func (l *Limiter) ipChan(ip string) chan struct{} {
 	return ch
 }
 
-// Middleware wraps the given handler, rate-limiting POST and PATCH requests.
+// Middleware wraps the given handler, rate-limiting POST, PUT and PATCH
+// requests per client. Clients are told apart by r.RemoteAddr, which
+// clientip.Resolver sets to the client's address behind trusted proxies.
 func (l *Limiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		ip := realIP(r)
+		ip := clientip.Host(r.RemoteAddr)
 		if !l.acquire(ip) {
+			metrics.RateLimited.Inc()
+			slog.Info("ratelimit: too many concurrent uploads", "client_ip", ip)
 			http.Error(w, "too many concurrent uploads", http.StatusTooManyRequests)
 			return
 		}
@@ -83,21 +94,3 @@ func (l *Limiter) Middleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-
-func realIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first (leftmost) IP in the chain.
-		if idx := strings.Index(xff, ","); idx != -1 {
-			return strings.TrimSpace(xff[:idx])
-		}
-		return strings.TrimSpace(xff)
-	}
-	if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
-		return strings.TrimSpace(xrip)
-	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return host
-}
@@ -2,11 +2,19 @@ package s3client
 
 import (
 	"context"
+	"errors"
 
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sharemk/internal/config"
+	"sharemk/internal/metrics"
+	"sharemk/internal/tracing"
 )
 
 func New(cfg *config.Config) (*s3.Client, error) {
@@ -25,7 +33,52 @@ func New(cfg *config.Config) (*s3.Client, error) {
 
 	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
 		o.UsePathStyle = true // required for Scaleway
+		o.APIOptions = append(o.APIOptions, traceCalls, countErrors)
 	})
 
 	return client, nil
 }
+
+// traceCalls adds a middleware that wraps every call, including its retries,
+// in a span named after the operation, e.g. "S3.PutObject".
+func traceCalls(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("TraceCalls",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			op := awsmiddleware.GetOperationName(ctx)
+			ctx, span := tracing.Start(ctx, "S3."+op,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("rpc.system", "aws-api"),
+					attribute.String("rpc.service", "S3"),
+					attribute.String("rpc.method", op),
+				),
+			)
+			out, md, err := next.HandleInitialize(ctx, in)
+			if id, ok := awsmiddleware.GetRequestIDMetadata(md); ok {
+				span.SetAttributes(attribute.String("aws.request_id", id))
+			}
+			tracing.End(span, err)
+			return out, md, err
+		}), middleware.After)
+}
+
+// countErrors adds a middleware that counts failed calls in
+// metrics.S3Errors. Calls cancelled by the caller, typically because a client
+// went away, are not counted.
+func countErrors(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CountErrors",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			out, md, err := next.HandleInitialize(ctx, in)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				code := "unknown"
+				var apiErr smithy.APIError
+				if errors.As(err, &apiErr) {
+					code = apiErr.ErrorCode()
+				} else if errors.Is(err, context.DeadlineExceeded) {
+					code = "timeout"
+				}
+				metrics.S3Errors.WithLabelValues(awsmiddleware.GetOperationName(ctx), code).Inc()
+			}
+			return out, md, err
+		}), middleware.After)
+}
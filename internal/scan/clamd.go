@@ -0,0 +1,148 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is the size of the INSTREAM chunks sent to clamd.
+const chunkSize = 64 << 10
+
+// Clamd talks to a clamd daemon over TCP or a Unix socket.
+type Clamd struct {
+	network string
+	addr    string
+}
+
+// NewClamd parses addr, which is "tcp://host:port", "unix:///path/to/socket",
+// a bare "host:port" or an absolute socket path.
+func NewClamd(addr string) (*Clamd, error) {
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		return &Clamd{network: "tcp", addr: strings.TrimPrefix(addr, "tcp://")}, nil
+	case strings.HasPrefix(addr, "unix://"):
+		return &Clamd{network: "unix", addr: strings.TrimPrefix(addr, "unix://")}, nil
+	case strings.HasPrefix(addr, "/"):
+		return &Clamd{network: "unix", addr: addr}, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("scan: invalid clamd address %q", addr)
+	}
+	return &Clamd{network: "tcp", addr: addr}, nil
+}
+
+// Ping checks that clamd answers.
+func (c *Clamd) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "zPING\x00", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("scan: unexpected clamd reply %q", reply)
+	}
+	return nil
+}
+
+// Scan streams r to clamd with the INSTREAM command. It returns the name of
+// the signature found, or "" if the data is clean.
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (string, error) {
+	reply, err := c.command(ctx, "zINSTREAM\x00", func(w io.Writer) error {
+		buf := make([]byte, 4+chunkSize)
+		for {
+			n, err := io.ReadFull(r, buf[4:])
+			if n > 0 {
+				binary.BigEndian.PutUint32(buf[:4], uint32(n))
+				if _, werr := w.Write(buf[:4+n]); werr != nil {
+					return werr
+				}
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil {
+				return &readError{err}
+			}
+		}
+		_, err := w.Write([]byte{0, 0, 0, 0})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or
+	// "INSTREAM size limit exceeded. ERROR".
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("scan: clamd: %s", reply)
+	}
+}
+
+// command sends cmd, then lets body write any payload, and reads the
+// NUL-terminated reply.
+func (c *Clamd) command(ctx context.Context, cmd string, body func(io.Writer) error) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return "", fmt.Errorf("scan: connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline) //nolint:errcheck
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) }) //nolint:errcheck
+	defer stop()
+
+	w := bufio.NewWriterSize(conn, 4+chunkSize)
+	if _, err := w.WriteString(cmd); err != nil {
+		return "", err
+	}
+	if body != nil {
+		if err := body(w); err != nil {
+			var re *readError
+			if errors.As(err, &re) {
+				return "", re.err
+			}
+			// clamd closes the connection once a stream exceeds its
+			// StreamMaxLength; its reply says so more clearly than the
+			// write error.
+			if reply, rerr := readReply(conn); rerr == nil {
+				return reply, nil
+			}
+			return "", err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		if reply, rerr := readReply(conn); rerr == nil {
+			return reply, nil
+		}
+		return "", err
+	}
+	return readReply(conn)
+}
+
+// readError is an error reading the data to scan, as opposed to writing it
+// to clamd.
+type readError struct{ err error }
+
+func (e *readError) Error() string { return e.err.Error() }
+
+func readReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(r).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("scan: reading clamd reply: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
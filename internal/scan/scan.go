@@ -0,0 +1,202 @@
+// Package scan checks completed uploads for malware with clamd.
+//
+// Uploads are marked pending when they are created, so they cannot be
+// downloaded until the scan after completion has recorded its verdict in
+// the upload's metadata. Infected files are removed from the upload area,
+// either moved to a quarantine prefix or deleted outright; their .info
+// object stays behind until expiry so downloads can say why the file is
+// gone.
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/config"
+	"sharemk/internal/metrics"
+	"sharemk/internal/storage"
+)
+
+// Metadata keys holding the scan verdict.
+const (
+	StatusKey    = "scan-status"
+	SignatureKey = "scan-signature"
+)
+
+// Scan statuses.
+const (
+	// StatusPending uploads have not been scanned yet.
+	StatusPending = "pending"
+	// StatusClean uploads were scanned and found clean.
+	StatusClean = "clean"
+	// StatusInfected uploads matched a signature and were removed.
+	StatusInfected = "infected"
+	// StatusFailed uploads could not be scanned, or were larger than
+	// SCAN_MAX_SIZE, and SCAN_FAIL_OPEN is off.
+	StatusFailed = "failed"
+	// StatusSkipped uploads were not scanned: they are end-to-end
+	// encrypted, or could not be scanned with SCAN_FAIL_OPEN on.
+	StatusSkipped = "skipped"
+)
+
+// errTooLarge is returned for uploads larger than SCAN_MAX_SIZE, which are
+// blocked like any other upload that could not be scanned.
+var errTooLarge = errors.New("upload is larger than SCAN_MAX_SIZE")
+
+// scanTimeout bounds a single scan, including reading the file back from
+// the storage backend.
+const scanTimeout = 10 * time.Minute
+
+type Scanner struct {
+	store    storage.Backend
+	clamd    *Clamd
+	maxSize  int64
+	action   string
+	prefix   string
+	failOpen bool
+}
+
+// New returns a Scanner for cfg.ClamdAddr. Scanning is disabled when no
+// address is configured.
+func New(cfg *config.Config, store storage.Backend) (*Scanner, error) {
+	s := &Scanner{
+		store:    store,
+		maxSize:  cfg.ScanMaxSize,
+		action:   cfg.ScanAction,
+		prefix:   cfg.ScanQuarantinePrefix,
+		failOpen: cfg.ScanFailOpen,
+	}
+	if cfg.ClamdAddr != "" {
+		c, err := NewClamd(cfg.ClamdAddr)
+		if err != nil {
+			return nil, err
+		}
+		s.clamd = c
+	}
+	return s, nil
+}
+
+// Enabled reports whether uploads are scanned.
+func (s *Scanner) Enabled() bool {
+	return s.clamd != nil
+}
+
+// Ping checks that clamd answers.
+func (s *Scanner) Ping(ctx context.Context) error {
+	return s.clamd.Ping(ctx)
+}
+
+// Prepare marks a new upload as pending a scan, replacing any scan status
+// the client tried to set.
+func (s *Scanner) Prepare(meta map[string]string) {
+	delete(meta, StatusKey)
+	delete(meta, SignatureKey)
+	if s.Enabled() {
+		meta[StatusKey] = StatusPending
+	}
+}
+
+// Scan scans the completed upload whose data object is stored at key and
+// records the verdict in its .info object, quarantining the file if it is
+// infected. ctx must carry the encryption key of SSE-C uploads. It returns
+// info with the updated metadata.
+func (s *Scanner) Scan(ctx context.Context, key string, info handler.FileInfo) handler.FileInfo {
+	if !s.Enabled() || info.MetaData[StatusKey] != StatusPending {
+		return info
+	}
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+
+	status, signature, err := s.scan(ctx, key, info)
+	if err != nil {
+		slog.Error("scan: failed to scan upload", "upload_id", info.ID, "error", err)
+		status = StatusFailed
+		if s.failOpen {
+			status = StatusSkipped
+		}
+	}
+	metrics.Scans.WithLabelValues(status).Inc()
+
+	meta := make(map[string]string, len(info.MetaData)+1)
+	for k, v := range info.MetaData {
+		meta[k] = v
+	}
+	meta[StatusKey] = status
+	if signature != "" {
+		meta[SignatureKey] = signature
+	}
+	info.MetaData = meta
+
+	if status == StatusInfected {
+		slog.Warn("scan: upload is infected", "upload_id", info.ID, "signature", signature, "action", s.action)
+		if err := s.quarantine(ctx, key, info); err != nil {
+			slog.Error("scan: failed to quarantine upload", "upload_id", info.ID, "error", err)
+		}
+	} else {
+		slog.Info("scan: upload scanned", "upload_id", info.ID, "status", status)
+	}
+
+	if err := storage.WriteInfo(ctx, s.store, key, info); err != nil {
+		slog.Error("scan: failed to record scan result", "upload_id", info.ID, "status", status, "error", err)
+	}
+	return info
+}
+
+// scan returns the status of the upload's data and the signature it matched.
+func (s *Scanner) scan(ctx context.Context, key string, info handler.FileInfo) (string, string, error) {
+	if info.MetaData["e2e"] == "1" {
+		return StatusSkipped, "", nil
+	}
+	if info.Size > s.maxSize {
+		return "", "", errTooLarge
+	}
+
+	body, err := s.store.Get(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+	defer body.Close()
+
+	signature, err := s.clamd.Scan(ctx, body)
+	if err != nil {
+		return "", "", err
+	}
+	if signature != "" {
+		return StatusInfected, signature, nil
+	}
+	return StatusClean, "", nil
+}
+
+// quarantine removes the data of an infected upload, first copying it to
+// the quarantine prefix if configured to. The copy is stored unencrypted so
+// it can be examined, which is why SSE-C uploads are deleted instead: their
+// owner asked for the data not to be stored in the clear.
+func (s *Scanner) quarantine(ctx context.Context, key string, info handler.FileInfo) error {
+	if s.action == "quarantine" && info.MetaData["encryption"] == "sse-c" {
+		slog.Warn("scan: deleting encrypted upload instead of quarantining it", "upload_id", info.ID)
+	} else if s.action == "quarantine" {
+		body, err := s.store.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		err = s.store.Put(ctx, s.prefix+info.ID, io.LimitReader(body, info.Size), info.Size, "application/octet-stream")
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("copying to quarantine: %w", err)
+		}
+		// Keep the upload's metadata, with the verdict, next to it.
+		if b, err := json.Marshal(info); err == nil {
+			if err := s.store.Put(ctx, s.prefix+info.ID+".info", bytes.NewReader(b), int64(len(b)), "application/json"); err != nil {
+				slog.Warn("scan: failed to write upload info to quarantine", "upload_id", info.ID, "error", err)
+			}
+		}
+	}
+	return s.store.Delete(ctx, key)
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/collection"
+	"sharemk/internal/contenttype"
+	"sharemk/internal/metrics"
+	"sharemk/internal/qr"
+	"sharemk/internal/scan"
+	"sharemk/internal/ui"
+	"sharemk/internal/webhook"
+)
+
+// collectionFile is a member of a collection as listed by GET /c/{id}.
+type collectionFile struct {
+	FileID      string `json:"file_id"`
+	Filename    string `json:"filename"`
+	Path        string `json:"path,omitempty"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+	DownloadURL string `json:"download_url"`
+	ScanStatus  string `json:"scan_status,omitempty"`
+}
+
+// handleCreateCollection creates a collection that uploads can then join:
+//
+//	POST /api/v1/collections
+//	{"name": "Incident 4711", "expires_in": "7d"}
+//
+// The response carries the collection's token, which uploads present in the
+// collection-token metadata. It is returned only here.
+func (s *Server) handleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.S3SSEC == "always" {
+		writeJSONError(w, http.StatusBadRequest, "collections are not available on this server because every upload is encrypted")
+		return
+	}
+
+	var body struct {
+		Name      string `json:"name"`
+		ExpiresIn string `json:"expires_in"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, "body must be JSON with optional name, expires_in or expires_at")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	col, err := s.collections.Create(ctx, body.Name, body.ExpiresIn, body.ExpiresAt)
+	if err != nil {
+		writeManageError(w, "", err)
+		return
+	}
+
+	resp := map[string]any{
+		"collection_id":    col.ID,
+		"collection_token": col.Token,
+		"url":              s.collections.URL(col.ID),
+		"zip_url":          s.collections.URL(col.ID) + ".zip",
+		"expires_at":       col.ExpiresAt.Format(time.RFC3339),
+	}
+	if col.Name != "" {
+		resp["name"] = col.Name
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// handleCollection lists the files of a collection: as an HTML page for
+// browsers and as JSON otherwise. GET /c/{id}.zip downloads all of them
+// instead (see serveZip).
+func (s *Server) handleCollection(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if zipID, ok := strings.CutSuffix(id, ".zip"); ok {
+		s.serveZip(w, r, zipID)
+		return
+	}
+
+	col, files, ok := s.loadCollection(w, r, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+
+	if wantsLandingPage(r) {
+		page := ui.Collection{
+			Name:      col.Name,
+			ExpiresAt: col.ExpiresAt,
+			ZipURL:    r.URL.Path + ".zip",
+		}
+		for _, info := range files {
+			page.Files = append(page.Files, ui.CollectionFile{
+				Path:        entryName(info),
+				ContentType: displayType(info),
+				Size:        info.Size,
+				URL:         s.cfg.TUSBasePath + info.ID,
+				Unavailable: unavailable(info),
+			})
+		}
+		if code, err := qr.Encode(s.collections.URL(col.ID)); err == nil {
+			page.QRCode = template.HTML(code.SVG())
+		}
+		ui.CollectionPage(w, page)
+		return
+	}
+
+	list := make([]collectionFile, 0, len(files))
+	for _, info := range files {
+		list = append(list, collectionFile{
+			FileID:      info.ID,
+			Filename:    info.MetaData["filename"],
+			Path:        info.MetaData[collection.PathKey],
+			ContentType: displayType(info),
+			SizeBytes:   info.Size,
+			DownloadURL: s.manager.DownloadURL(info.ID),
+			ScanStatus:  info.MetaData[scan.StatusKey],
+		})
+	}
+	resp := map[string]any{
+		"collection_id": col.ID,
+		"url":           s.collections.URL(col.ID),
+		"zip_url":       s.collections.URL(col.ID) + ".zip",
+		"expires_at":    col.ExpiresAt.Format(time.RFC3339),
+		"files":         list,
+	}
+	if col.Name != "" {
+		resp["name"] = col.Name
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// serveZip streams every downloadable file of a collection as one zip
+// archive. The archive is written while the files are read from storage, so
+// nothing is buffered beyond io.Copy's buffer; files are stored rather than
+// compressed, which keeps this cheap and leaves already compressed formats
+// as they are. Files still being scanned for malware are left out.
+func (s *Server) serveZip(w http.ResponseWriter, r *http.Request, id string) {
+	col, files, ok := s.loadCollection(w, r, id)
+	if !ok {
+		return
+	}
+
+	name := col.Name
+	if name == "" {
+		name = "collection-" + col.ID
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/zip")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+
+	dw := &downloadWriter{ResponseWriter: w}
+	zw := zip.NewWriter(dw)
+	names := map[string]bool{}
+	now := time.Now()
+	for _, info := range files {
+		if unavailable(info) != "" {
+			continue
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     uniqueName(names, entryName(info)),
+			Method:   zip.Store,
+			Modified: now,
+		})
+		if err != nil {
+			return
+		}
+		if err := s.copyUpload(r.Context(), fw, info.ID); err != nil {
+			// The status has been sent; abort so the client does not take
+			// a truncated archive for a complete one.
+			slog.Error("server: failed to add file to zip", "collection_id", col.ID, "upload_id", info.ID, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		s.notifier.Notify(webhook.UploadDownloaded, info, time.Time{})
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+
+	metrics.ZipDownloads.Inc()
+	metrics.BytesServed.Add(float64(dw.written))
+}
+
+// copyUpload writes the data of upload id to w.
+func (s *Server) copyUpload(ctx context.Context, w io.Writer, id string) error {
+	body, err := s.store.Get(ctx, s.store.UploadKey(id))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// loadCollection returns collection id and its completed files, sorted by
+// name. It returns false after writing an error response if there is
+// nothing to serve.
+func (s *Server) loadCollection(w http.ResponseWriter, r *http.Request, id string) (collection.Collection, []handler.FileInfo, bool) {
+	col, err := s.collections.Get(r.Context(), id)
+	if errors.Is(err, collection.ErrNotFound) {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return collection.Collection{}, nil, false
+	}
+	if err != nil {
+		slog.Error("server: failed to read collection", "collection_id", id, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return collection.Collection{}, nil, false
+	}
+
+	all, err := s.collections.Files(r.Context(), id)
+	if err != nil {
+		slog.Error("server: failed to list collection", "collection_id", id, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return collection.Collection{}, nil, false
+	}
+	files := all[:0]
+	for _, info := range all {
+		if uploadComplete(info) && info.MetaData[scan.StatusKey] != scan.StatusInfected {
+			files = append(files, info)
+		}
+	}
+	slices.SortFunc(files, func(a, b handler.FileInfo) int { return strings.Compare(entryName(a), entryName(b)) })
+	return col, files, true
+}
+
+// unavailable says why a file in a collection cannot be downloaded yet, or
+// returns "" if it can; see checkScan.
+func unavailable(info handler.FileInfo) string {
+	switch info.MetaData[scan.StatusKey] {
+	case scan.StatusPending:
+		return "being scanned for malware"
+	case scan.StatusFailed:
+		return "could not be scanned for malware"
+	}
+	return ""
+}
+
+// entryName returns the name of an upload within a collection and its zip:
+// its path, if it was uploaded as part of a folder, or else its file name.
+// Uploaders choose both, so the file name is reduced to a base name that
+// cannot point outside the directory the archive is extracted to, and paths
+// are checked again even though PreCreate has already cleaned them.
+func entryName(info handler.FileInfo) string {
+	if p, ok := info.MetaData[collection.PathKey]; ok {
+		if clean, err := collection.CleanPath(p); err == nil {
+			return clean
+		}
+	}
+	name := path.Base(strings.ReplaceAll(info.MetaData["filename"], `\`, "/"))
+	if name == "." || name == "/" || name == ".." {
+		return info.ID
+	}
+	return name
+}
+
+// displayType is the type shown for an upload. Active content is served as
+// plain text; this says what it really is.
+func displayType(info handler.FileInfo) string {
+	if detected := info.MetaData[contenttype.MetaKey]; detected != "" {
+		return detected
+	}
+	t, _ := contenttype.Serve(info.MetaData)
+	return t
+}
+
+// uniqueName returns name, or name with a counter before its extension if
+// it is already in names, and records the result in names.
+func uniqueName(names map[string]bool, name string) string {
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; names[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	names[unique] = true
+	return unique
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/downloads"
+	"sharemk/internal/metrics"
+	"sharemk/internal/storage"
+	"sharemk/internal/webhook"
+)
+
+// serveFile writes the data of a completed upload. Unlike tusd's GET
+// handler, which always streams the whole object, it answers Range requests
+// with 206 Partial Content (including multipart byte ranges), reading only
+// the requested bytes from the storage backend, and honours If-None-Match,
+// If-Modified-Since and If-Range against the data object's ETag and
+// modification time. That lets browsers seek in videos and lets download
+// managers resume, for example with curl -C -.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, info handler.FileInfo, obj storage.ObjectInfo, contentType string, attachment bool) {
+	h := w.Header()
+	h.Set("Content-Disposition", contentDisposition(info, attachment))
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	if !attachment {
+		// Should anything inline still be active content, it runs in a
+		// sandbox with an opaque origin, not on this one.
+		h.Set("Content-Security-Policy", "sandbox")
+	}
+	if obj.ETag != "" {
+		h.Set("ETag", obj.ETag)
+	}
+	// tusd allowed cross-origin downloads; keep doing so, and let scripts
+	// see the headers needed to resume.
+	if origin := r.Header.Get("Origin"); origin != "" {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Expose-Headers", "Content-Disposition, Content-Range, Accept-Ranges, ETag, Last-Modified")
+	}
+
+	content := &rangeReader{
+		ctx:   r.Context(),
+		store: s.store,
+		key:   obj.Key,
+		size:  obj.Size,
+		spans: parseRanges(r.Header.Get("Range"), obj.Size),
+	}
+	defer content.Close()
+	http.ServeContent(w, r, "", obj.LastModified, content)
+}
+
+// redirectDownload answers a download with a redirect to a presigned S3 URL,
+// so that the file's bytes do not pass through this server. It only does so
+// for uploads that need no checks on every request: password-protected
+// uploads, uploads with a download limit (a presigned URL can be fetched
+// any number of times), SSE-C and end-to-end encrypted uploads are served
+// directly. The URL is valid for S3_PRESIGN_TTL, but never past the
+// upload's expiry. It returns false if the download should be served
+// directly.
+func (s *Server) redirectDownload(w http.ResponseWriter, r *http.Request, id string, info handler.FileInfo, contentType string, attachment bool) bool {
+	if s.presigner == nil ||
+		info.MetaData["password-hash"] != "" ||
+		info.MetaData["encryption"] == "sse-c" ||
+		info.MetaData["e2e"] == "1" ||
+		!uploadComplete(info) {
+		return false
+	}
+	if _, limited := downloads.Limit(info.MetaData); limited {
+		return false
+	}
+
+	key := s.store.UploadKey(id)
+	tags, err := s.store.GetTags(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return true
+	}
+	if err != nil {
+		slog.Error("server: failed to read upload tags", "upload_id", id, "error", err)
+		return false
+	}
+	ttl := s.cfg.S3PresignTTL
+	if expiresAt, err := time.Parse(time.RFC3339, tags["expires-at"]); err == nil {
+		left := time.Until(expiresAt)
+		if left <= 0 {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return true
+		}
+		ttl = min(ttl, left)
+	}
+
+	url, err := s.presigner.PresignGet(r.Context(), key, ttl, contentType, contentDisposition(info, attachment))
+	if err != nil {
+		slog.Error("server: failed to presign download", "upload_id", id, "error", err)
+		return false
+	}
+
+	metrics.DownloadRedirects.Inc()
+	s.notifyDownload(r, info)
+	// The URL stops working after ttl; do not let anyone keep it.
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, url, http.StatusFound)
+	return true
+}
+
+// notifyDownload sends the download webhook for info. Players and download
+// managers fetch a file in many ranges; only the one starting at the
+// beginning counts.
+func (s *Server) notifyDownload(r *http.Request, info handler.FileInfo) {
+	if rng := r.Header.Get("Range"); rng == "" || strings.HasPrefix(rng, "bytes=0-") {
+		s.notifier.Notify(webhook.UploadDownloaded, info, time.Time{})
+	}
+}
+
+// contentDisposition returns the Content-Disposition of a download of info.
+func contentDisposition(info handler.FileInfo, attachment bool) string {
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+	params := map[string]string{}
+	if name := info.MetaData["filename"]; name != "" {
+		params["filename"] = name
+	}
+	return mime.FormatMediaType(disposition, params)
+}
+
+// statUpload returns the data object of a completed upload. It returns false
+// after writing an error response if there is nothing to serve.
+func (s *Server) statUpload(w http.ResponseWriter, r *http.Request, id string, info handler.FileInfo) (storage.ObjectInfo, bool) {
+	if !uploadComplete(info) {
+		writeIncomplete(w)
+		return storage.ObjectInfo{}, false
+	}
+	obj, err := s.store.Stat(r.Context(), s.store.UploadKey(id))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return storage.ObjectInfo{}, false
+	}
+	if err != nil {
+		slog.Error("server: failed to stat upload", "upload_id", id, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return storage.ObjectInfo{}, false
+	}
+	return obj, true
+}
+
+// uploadComplete reports whether all of an upload's data has arrived.
+func uploadComplete(info handler.FileInfo) bool {
+	return !info.SizeIsDeferred && info.Offset >= info.Size
+}
+
+func writeIncomplete(w http.ResponseWriter) {
+	http.Error(w, "this file is still being uploaded", http.StatusConflict)
+}
+
+// notModified reports whether the client's cached copy of obj is current,
+// following the precedence of RFC 9110: If-Modified-Since is ignored when
+// If-None-Match is present.
+func notModified(r *http.Request, obj storage.ObjectInfo) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if obj.ETag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(obj.ETag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || obj.LastModified.IsZero() {
+		return false
+	}
+	return !obj.LastModified.Truncate(time.Second).After(ims)
+}
+
+// writeNotModified answers a conditional GET whose cached copy is current.
+func writeNotModified(w http.ResponseWriter, obj storage.ObjectInfo) {
+	if obj.ETag != "" {
+		w.Header().Set("ETag", obj.ETag)
+	}
+	if !obj.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// rangeReader is the io.ReadSeeker http.ServeContent reads the object
+// through. Seeking is free; the first Read after a seek opens a ranged read
+// of the requested range starting at the new offset, or of the rest of the
+// object if none does, so each range costs one GetObject and no bytes
+// outside it are fetched.
+type rangeReader struct {
+	ctx   context.Context
+	store storage.Backend
+	key   string
+	size  int64
+	spans []span
+
+	pos     int64
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("server: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("server: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.body != nil && r.bodyPos != r.pos {
+		r.Close()
+	}
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.store.GetRange(r.ctx, r.key, r.pos, r.length())
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.bodyPos = body, r.pos
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	r.bodyPos = r.pos
+	if err == io.EOF && r.pos < r.size {
+		// Reading on past the requested range, as when ServeContent ignores
+		// the Range header, opens the next part on the next Read.
+		r.Close()
+		err = nil
+	}
+	return n, err
+}
+
+// length returns how many bytes to read from r.pos: up to the end of the
+// requested range starting there, or to the end of the object.
+func (r *rangeReader) length() int64 {
+	for _, sp := range r.spans {
+		if sp.start == r.pos {
+			return sp.end - sp.start
+		}
+	}
+	return r.size - r.pos
+}
+
+func (r *rangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// span is a byte range [start, end) of an object.
+type span struct {
+	start, end int64
+}
+
+// parseRanges returns the byte ranges a Range header asks for in an object
+// of the given size. Ranges it cannot parse or satisfy are left out;
+// http.ServeContent decides how to answer the request.
+func parseRanges(header string, size int64) []span {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil
+	}
+	var spans []span
+	for _, ra := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(ra), "-")
+		if !ok {
+			continue
+		}
+		var sp span
+		if first == "" {
+			// bytes=-n is the last n bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n <= 0 {
+				continue
+			}
+			sp = span{start: max(size-n, 0), end: size}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 || start >= size {
+				continue
+			}
+			sp = span{start: start, end: size}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					continue
+				}
+				sp.end = min(end+1, size)
+			}
+		}
+		spans = append(spans, sp)
+	}
+	return spans
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/storage"
+)
+
+// withEncryptionKey attaches the SSE-C key of an upload to the request
+// context, where the S3 backend picks it up (see storage.WithEncryptionKey).
+//
+// On upload creation a fresh key is issued when S3_SSE_C is "always", or when
+// it is "optional" and the client asked for encryption with the encrypt
+// metadata key. The key is returned once in the Upload-Encryption-Key header
+// and never stored. Every later request on the upload's data has to send it
+// back in an X-Share-Key header. It is never taken from the URL, which ends
+// up in logs, traces and Referer headers: share links carry it in the
+// fragment (#key=), which browsers do not send, and the landing and password
+// pages pass it on from there.
+func (s *Server) withEncryptionKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.S3SSEC == "off" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodPost && !isPasswordForm(r) {
+			meta := handler.ParseMetadataHeader(r.Header.Get("Upload-Metadata"))
+			if s.cfg.S3SSEC == "always" || storage.EncryptionRequested(meta) {
+				key, err := storage.NewEncryptionKey()
+				if err != nil {
+					slog.Error("server: failed to generate encryption key", "error", err)
+					http.Error(w, "internal server error", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Upload-Encryption-Key", storage.EncodeEncryptionKey(key))
+				r = r.WithContext(storage.WithEncryptionKey(r.Context(), key))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		raw := r.Header.Get("X-Share-Key")
+		if raw == "" && isPasswordForm(r) {
+			raw = r.PostFormValue("key")
+		}
+		if raw != "" {
+			key, err := storage.ParseEncryptionKey(raw)
+			if err != nil {
+				http.Error(w, "invalid encryption key", http.StatusBadRequest)
+				return
+			}
+			r = r.WithContext(storage.WithEncryptionKey(r.Context(), key))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkEncryptionKey makes sure a download of an SSE-C encrypted upload
+// carries the right key. Browsers opening a link get through without one:
+// they are shown the landing page or the password form, which read the key
+// from the link's fragment. It returns true when the request may proceed;
+// otherwise it has already written an error response.
+func checkEncryptionKey(w http.ResponseWriter, r *http.Request, info handler.FileInfo) bool {
+	if info.MetaData["encryption"] != "sse-c" {
+		return true
+	}
+
+	// Keep responses made with the key out of shared caches.
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	key, ok := storage.EncryptionKey(r.Context())
+	if !ok && r.Method == http.MethodGet && wantsLandingPage(r) {
+		return true
+	}
+	if !ok {
+		http.Error(w, "this file is encrypted; send its key in the X-Share-Key header", http.StatusUnauthorized)
+		return false
+	}
+	want := info.MetaData["encryption-key-hash"]
+	if subtle.ConstantTimeCompare([]byte(storage.EncryptionKeyHash(key)), []byte(want)) != 1 {
+		http.Error(w, "wrong encryption key", http.StatusForbidden)
+		return false
+	}
+	return true
+}
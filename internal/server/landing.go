@@ -0,0 +1,123 @@
+package server
+
+import (
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/contenttype"
+	"sharemk/internal/downloads"
+	"sharemk/internal/qr"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/ui"
+)
+
+// textTypes are previewed as text besides text/*.
+var textTypes = map[string]bool{
+	"application/json":   true,
+	"application/yaml":   true,
+	"application/x-yaml": true,
+	"application/toml":   true,
+	"application/x-sh":   true,
+	"application/sql":    true,
+}
+
+// wantsLandingPage reports whether r is a browser opening a download link,
+// as opposed to a script, a media element or a command-line client fetching
+// the file. ?raw=1 and ?dl=1 always get the file.
+func wantsLandingPage(r *http.Request) bool {
+	q := r.URL.Query()
+	if q.Get("raw") == "1" || q.Get("dl") == "1" || r.Header.Get("Range") != "" {
+		return false
+	}
+	// Browsers send Sec-Fetch-Dest; images, players and frames are not
+	// documents. Clients that do not send it are judged by Accept alone.
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" && dest != "document" {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// landingPage renders the landing page of upload id from its metadata.
+func (s *Server) landingPage(w http.ResponseWriter, r *http.Request, id string, info handler.FileInfo) {
+	if !uploadComplete(info) {
+		writeIncomplete(w)
+		return
+	}
+
+	contentType, _ := contenttype.Serve(info.MetaData)
+	filename := info.MetaData["filename"]
+	l := ui.Landing{
+		Filename:    filename,
+		ContentType: displayType(info),
+		Size:        info.Size,
+		Encrypted:   info.MetaData["encryption"] == "sse-c",
+	}
+
+	tags, err := s.store.GetTags(r.Context(), s.store.UploadKey(id))
+	if err != nil {
+		slog.Warn("server: failed to read upload tags", "upload_id", id, "error", err)
+	}
+	if t, err := time.Parse(time.RFC3339, tags["expires-at"]); err == nil {
+		l.ExpiresAt = t
+	}
+
+	link := s.manager.DownloadURL(id)
+	if code := info.MetaData[shortlink.MetaKey]; code != "" {
+		link = s.links.URL(code)
+	}
+	l.DownloadURL = r.URL.Path + "?dl=1"
+	l.PreviewURL = r.URL.Path + "?raw=1"
+
+	// Every preview request would count as a download.
+	if n, ok := downloads.Limit(info.MetaData); ok {
+		l.MaxDownloads = n
+	} else {
+		l.Preview = previewKind(contentType)
+		// An encrypted PDF could only be shown from a blob URL, without
+		// the sandbox the server puts around inline files.
+		if l.Encrypted && l.Preview == "pdf" {
+			l.Preview = ""
+		}
+		if l.Preview == "text" {
+			l.Language = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+		}
+	}
+
+	// The key of an encrypted upload is only in the fragment, which the
+	// server never sees, so a QR code of the link would not open the file.
+	if !l.Encrypted {
+		if code, err := qr.Encode(link); err == nil {
+			l.QRCode = template.HTML(code.SVG())
+		}
+	}
+
+	ui.LandingPage(w, l)
+}
+
+// previewKind returns how the landing page previews a file served as
+// contentType.
+func previewKind(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(t, "image/"):
+		return "image"
+	case strings.HasPrefix(t, "video/"):
+		return "video"
+	case strings.HasPrefix(t, "audio/"):
+		return "audio"
+	case t == "application/pdf":
+		return "pdf"
+	case strings.HasPrefix(t, "text/") || textTypes[t]:
+		return "text"
+	}
+	return ""
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"sharemk/internal/manage"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+	"sharemk/internal/webhook"
+)
+
+// handleFileInfo returns the metadata of an upload in the same shape as the
+// get_file_info MCP tool:
+//
+//	GET /api/v1/files/{id}
+//	Authorization: Bearer <management token>
+func (s *Server) handleFileInfo(w http.ResponseWriter, r *http.Request) {
+	token, ok := requireBearer(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	id := r.PathValue("id")
+	info, err := s.manager.Info(ctx, id, token)
+	if err != nil {
+		writeManageError(w, id, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleDeleteFile permanently deletes an upload, like the delete_file MCP
+// tool:
+//
+//	DELETE /api/v1/files/{id}
+//	Authorization: Bearer <management token>
+func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	token, ok := requireBearer(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	id := r.PathValue("id")
+	if err := s.manager.Delete(ctx, id, token); err != nil {
+		writeManageError(w, id, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": true, "file_id": id})
+}
+
+// handleUpdateExpiry changes the expiry of an upload:
+//
+//	PATCH /files/{id}/expiry
+//	Authorization: Bearer <management token>
+//	{"expires_in": "3d"}  or  {"expires_at": "2026-10-20T00:00:00Z"}
+func (s *Server) handleUpdateExpiry(w http.ResponseWriter, r *http.Request) {
+	token, ok := requireBearer(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ExpiresIn string `json:"expires_in"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "body must be JSON with expires_in or expires_at")
+		return
+	}
+	if body.ExpiresIn == "" && body.ExpiresAt == "" {
+		writeJSONError(w, http.StatusBadRequest, "expires_in or expires_at is required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	id := r.PathValue("id")
+	expiresTime, err := s.manager.UpdateExpiry(ctx, id, token, body.ExpiresIn, body.ExpiresAt)
+	if err != nil {
+		writeManageError(w, id, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"file_id":    id,
+		"expires_at": expiresTime.Format(time.RFC3339),
+	})
+}
+
+// requireManagementToken guards tusd's DELETE (upload termination) with the
+// upload's management token, so that knowing the download URL is not enough
+// to delete a file. After tusd has terminated the upload, the objects it does
+// not know about, such as the download counter, are removed as well.
+func (s *Server) requireManagementToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := requireBearer(w, r)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		id := r.PathValue("id")
+		info, err := s.manager.Authorize(ctx, id, token)
+		if err != nil {
+			writeManageError(w, id, err)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == http.StatusNoContent {
+			if err := s.store.Delete(ctx, storage.UploadObjects(s.store.UploadKey(id))...); err != nil {
+				slog.Warn("server: failed to clean up deleted upload", "file_id", id, "error", err)
+			}
+			if err := s.links.Delete(ctx, info.MetaData[shortlink.MetaKey]); err != nil {
+				slog.Warn("server: failed to delete short link of deleted upload", "file_id", id, "error", err)
+			}
+			s.notifier.Notify(webhook.UploadDeleted, info, time.Time{})
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// requireBearer returns the management token of the request, or responds
+// with 401 if there is none.
+func requireBearer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="share.mk"`)
+		writeJSONError(w, http.StatusUnauthorized, "management token required")
+	}
+	return token, ok
+}
+
+// bearerToken extracts the management token from an Authorization: Bearer
+// header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// writeManageError maps errors from the manage package to HTTP responses. A
+// wrong token is reported as 404 so it cannot be told apart from a missing
+// upload.
+func writeManageError(w http.ResponseWriter, id string, err error) {
+	var invalid *manage.InvalidError
+	switch {
+	case errors.Is(err, manage.ErrUnauthorized):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.As(err, &invalid):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		slog.Error("server: management request failed", "file_id", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"io"
+	"net/http"
+
+	"sharemk/internal/metrics"
+)
+
+var tusBytesReceived = metrics.BytesReceived.WithLabelValues(metrics.SourceTus)
+
+// countUploadBytes counts the bytes of tus PATCH bodies as tusd reads them,
+// so interrupted uploads are counted too.
+func countUploadBytes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch && r.Body != nil {
+			r.Body = &countingBody{ReadCloser: r.Body}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type countingBody struct {
+	io.ReadCloser
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	tusBytesReceived.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/collection"
+	"sharemk/internal/password"
+	"sharemk/internal/ui"
+	"sharemk/internal/webhook"
+)
+
+// passwordAttemptWindow is the period over which wrong download passwords are
+// counted per file.
+const passwordAttemptWindow = 15 * time.Minute
+
+// privateMetadataKeys are kept in the .info object but never echoed back in
+// the Upload-Metadata header of tusd's HEAD responses.
+var privateMetadataKeys = []string{"password-hash", "mgmt-token", "encryption-key-hash", webhook.URLKey, collection.IDKey}
+
+// checkPassword enforces the download password of a protected upload. It
+// returns true when the download may proceed; otherwise it has already
+// written a response asking for the password.
+//
+// Browsers are shown a form that posts the password back to the download URL.
+// Other clients send it in an X-Share-Password header or as the password of
+// HTTP Basic auth (curl -u :secret).
+func (s *Server) checkPassword(w http.ResponseWriter, r *http.Request, id string, info handler.FileInfo) bool {
+	hash := info.MetaData["password-hash"]
+	if hash == "" {
+		return true
+	}
+
+	// Protected files must never end up in shared caches.
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	// Attempts are counted per data object: on S3 many tus IDs reach the
+	// same upload, and each must not bring a fresh allowance.
+	key := s.store.UploadKey(id)
+
+	pw, ok := providedPassword(r)
+	if ok {
+		// The attempt counts as failed until the password is verified, so
+		// that concurrent guesses cannot all get past the limit while the
+		// (deliberately slow) verification runs.
+		ok = s.attempts.Reserve(key)
+	} else if s.attempts.Allowed(key) {
+		askPassword(w, r, info, http.StatusUnauthorized, "")
+		return false
+	}
+	if !ok {
+		w.Header().Set("Retry-After", "900")
+		askPassword(w, r, info, http.StatusTooManyRequests, "Too many wrong passwords. Try again later.")
+		return false
+	}
+	if !password.Verify(hash, pw) {
+		askPassword(w, r, info, http.StatusUnauthorized, "Wrong password.")
+		return false
+	}
+
+	s.attempts.Reset(key)
+	return true
+}
+
+// providedPassword extracts the download password from the request.
+func providedPassword(r *http.Request) (string, bool) {
+	if pw := r.Header.Get("X-Share-Password"); pw != "" {
+		return pw, true
+	}
+	if _, pw, ok := r.BasicAuth(); ok && pw != "" {
+		return pw, true
+	}
+	if isPasswordForm(r) {
+		if pw := r.PostFormValue("password"); pw != "" {
+			return pw, true
+		}
+	}
+	return "", false
+}
+
+// askPassword responds with the password form for browsers and a plain
+// error with a Basic auth challenge for everything else.
+func askPassword(w http.ResponseWriter, r *http.Request, info handler.FileInfo, status int, msg string) {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		ui.PasswordPage(w, status, info.MetaData["filename"], msg)
+		return
+	}
+	// Scripts such as the end-to-end decryption page ask for the password
+	// themselves; a Basic challenge would pop up the browser's login dialog.
+	if status == http.StatusUnauthorized && r.Header.Get("X-Requested-With") == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="share.mk", charset="UTF-8"`)
+	}
+	if msg == "" {
+		msg = "password required"
+	}
+	http.Error(w, msg, status)
+}
+
+// isPasswordForm reports whether r is the password form posted to a download
+// URL, as opposed to a tus creation request.
+func isPasswordForm(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	ct := r.Header.Get("Content-Type")
+	return strings.HasPrefix(ct, "application/x-www-form-urlencoded") || strings.HasPrefix(ct, "multipart/form-data")
+}
+
+// asGet turns a password form submission into the GET tusd serves the file for.
+func asGet(r *http.Request) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.Method = http.MethodGet
+	r2.Body = http.NoBody
+	r2.ContentLength = 0
+	return r2
+}
+
+// hidePrivateMetadata strips privateMetadataKeys from the Upload-Metadata
+// header tusd sends in HEAD responses.
+func hidePrivateMetadata(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&metadataWriter{ResponseWriter: w}, r)
+	})
+}
+
+type metadataWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *metadataWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.ResponseWriter.Header()
+		if raw := h.Get("Upload-Metadata"); raw != "" {
+			meta := handler.ParseMetadataHeader(raw)
+			for _, k := range privateMetadataKeys {
+				delete(meta, k)
+			}
+			h.Set("Upload-Metadata", handler.SerializeMetadataHeader(meta))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metadataWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
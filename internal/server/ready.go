@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"sharemk/internal/config"
+	"sharemk/internal/scan"
+	"sharemk/internal/storage"
+)
+
+// readiness answers /readyz. Unlike /health, which only shows that the
+// process is up, it checks that the storage backend can actually be used,
+// and that clamd answers when uploads are scanned: without it no new upload
+// becomes downloadable.
+// Results are cached for cfg.ReadyCacheTTL so that frequent probes from
+// several sources do not each cost S3 requests.
+type readiness struct {
+	store      storage.Backend
+	scanner    *scan.Scanner
+	prefix     string
+	writeProbe bool
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	report  readyReport
+}
+
+type readyReport struct {
+	Status    string                `json:"status"`
+	Checks    map[string]readyCheck `json:"checks"`
+	CheckedAt time.Time             `json:"checked_at"`
+}
+
+type readyCheck struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+func newReadiness(cfg *config.Config, store storage.Backend, scanner *scan.Scanner) *readiness {
+	return &readiness{
+		store:      store,
+		scanner:    scanner,
+		prefix:     cfg.S3ObjectPrefix,
+		writeProbe: cfg.ReadyWriteProbe,
+		ttl:        cfg.ReadyCacheTTL,
+	}
+}
+
+// ServeHTTP responds 200 when every check passed and 503 otherwise.
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := rd.get(r.Context())
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func (rd *readiness) get(ctx context.Context) readyReport {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.checked.IsZero() && time.Since(rd.checked) < rd.ttl {
+		return rd.report
+	}
+
+	// Run the checks on behalf of every waiting prober, not just this one.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	report := readyReport{Status: "ok", Checks: map[string]readyCheck{}}
+	report.Checks["storage"] = runCheck("storage", func() error { return rd.store.Ping(ctx) })
+	if rd.writeProbe {
+		report.Checks["storage_write"] = runCheck("storage_write", func() error { return rd.probeWrite(ctx) })
+	}
+	if rd.scanner.Enabled() {
+		report.Checks["clamd"] = runCheck("clamd", func() error { return rd.scanner.Ping(ctx) })
+	}
+	for _, c := range report.Checks {
+		if c.Status != "ok" {
+			report.Status = "unavailable"
+		}
+	}
+	report.CheckedAt = time.Now().UTC()
+
+	rd.checked = time.Now()
+	rd.report = report
+	return report
+}
+
+// probeWrite writes and deletes a small object next to the uploads, where
+// bucket policies are most likely to be scoped. The dot in the name keeps
+// it from being taken for an upload should the delete fail.
+func (rd *readiness) probeWrite(ctx context.Context) error {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	key := rd.prefix + ".readyz-" + hex.EncodeToString(suffix)
+	body := []byte("ok")
+	if err := rd.store.Put(ctx, key, bytes.NewReader(body), int64(len(body)), "text/plain"); err != nil {
+		return err
+	}
+	return rd.store.Delete(ctx, key)
+}
+
+// runCheck times fn. The response only says whether a check failed or timed
+// out; the error itself, which may name the bucket or endpoint, is logged.
+func runCheck(name string, fn func() error) readyCheck {
+	start := time.Now()
+	err := fn()
+	c := readyCheck{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		slog.Warn("server: readiness check failed", "check", name, "error", err)
+		c.Status = "error"
+		c.Error = "failed"
+		if errors.Is(err, context.DeadlineExceeded) {
+			c.Error = "timeout"
+		}
+	}
+	return c
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/scan"
+)
+
+// checkScan refuses downloads of uploads that have not passed the malware
+// scan. Uploads without a scan status predate scanning or were made while
+// it was off, and are served. It returns true when the download may
+// proceed; otherwise it has already written an error response.
+func checkScan(w http.ResponseWriter, info handler.FileInfo) bool {
+	switch info.MetaData[scan.StatusKey] {
+	case scan.StatusPending:
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "this file is still being scanned for malware; try again shortly", http.StatusForbidden)
+	case scan.StatusFailed:
+		http.Error(w, "this file could not be scanned for malware and cannot be downloaded", http.StatusForbidden)
+	case scan.StatusInfected:
+		http.Error(w, "this file was removed because it contains malware", http.StatusUnavailableForLegalReasons)
+	default:
+		return true
+	}
+	return false
+}
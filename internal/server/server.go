@@ -1,46 +1,129 @@
 package server
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/clientip"
+	"sharemk/internal/collection"
 	"sharemk/internal/config"
+	"sharemk/internal/contenttype"
+	"sharemk/internal/downloads"
+	"sharemk/internal/lifetime"
+	"sharemk/internal/manage"
+	"sharemk/internal/metrics"
 	"sharemk/internal/openapi"
 	"sharemk/internal/ratelimit"
+	"sharemk/internal/scan"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+	"sharemk/internal/tracing"
 	"sharemk/internal/ui"
+	"sharemk/internal/webhook"
 )
 
 type Server struct {
-	cfg     *config.Config
-	handler http.Handler
+	cfg         *config.Config
+	store       storage.Backend
+	presigner   storage.Presigner
+	counter     *downloads.Counter
+	notifier    *webhook.Notifier
+	manager     *manage.Manager
+	collections *collection.Collections
+	links       *shortlink.Links
+	attempts    *ratelimit.Failures
+	policy      lifetime.Policy
+	uploads     http.Handler
+	handler     http.Handler
 }
 
-func New(cfg *config.Config, tusHandler *handler.Handler, limiter *ratelimit.Limiter, mcpHandler http.Handler, openapiHandler http.Handler) *Server {
+func New(cfg *config.Config, store storage.Backend, tusHandler *handler.Handler, limiter *ratelimit.Limiter, counter *downloads.Counter, notifier *webhook.Notifier, scanner *scan.Scanner, mcpHandler http.Handler, openapiHandler http.Handler) *Server {
+	collections := collection.New(cfg, store)
+	s := &Server{
+		cfg:         cfg,
+		store:       store,
+		counter:     counter,
+		notifier:    notifier,
+		manager:     manage.New(cfg, store, collections, notifier),
+		collections: collections,
+		links:       shortlink.New(cfg, store),
+		attempts:    ratelimit.NewFailures(cfg.PasswordMaxAttempts, passwordAttemptWindow),
+		policy:      lifetime.Policy{Min: cfg.ExpiryMin, Max: cfg.ExpiryMax, Default: cfg.ExpiryDefault},
+	}
+	if cfg.S3PresignGet {
+		s.presigner, _ = store.(storage.Presigner)
+	}
 	mux := http.NewServeMux()
 
 	mux.Handle("GET /{$}", ui.Handler())
 
+	// Liveness and readiness probes.
 	mux.HandleFunc("GET /health", healthHandler)
+	mux.Handle("GET /readyz", newReadiness(cfg, store, scanner))
+	mux.Handle("GET /metrics", metrics.Handler(cfg.MetricsToken))
 
 	// OpenAPI spec, Swagger UI, and LLM instructions.
 	mux.Handle("GET /openapi.json", openapiHandler)
 	mux.Handle("GET /docs", openapi.SwaggerUIHandler())
 	mux.Handle("GET /llms.txt", openapi.LLMsHandler())
 
-	// MCP Streamable HTTP transport (handles GET and POST).
-	mux.Handle("/mcp", mcpHandler)
+	// REST management API, authenticated with the upload's management token.
+	mux.HandleFunc("GET /api/v1/files/{id}", s.handleFileInfo)
+	mux.HandleFunc("DELETE /api/v1/files/{id}", s.handleDeleteFile)
+
+	// Collections group several uploads behind one link.
+	mux.HandleFunc("POST /api/v1/collections", s.handleCreateCollection)
+	mux.HandleFunc("GET /c/{id}", s.handleCollection)
+
+	// Short links redirect to the upload's download URL.
+	mux.HandleFunc("GET /s/{code}", s.handleShortLink)
+
+	// MCP Streamable HTTP transport. The methods are spelled out so that PUT
+	// /mcp does not clash with PUT /{filename} below.
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		mux.Handle(method+" /mcp", mcpHandler)
+	}
 
 	// tusd's internal router does strings.Trim(path, "/") to detect the
 	// creation endpoint (empty string = POST create). We must strip the base
 	// path prefix before handing off so tusd sees "/" not "/files/".
 	tusPrefix := strings.TrimSuffix(cfg.TUSBasePath, "/") // "/files/" → "/files"
 	strippedTus := http.StripPrefix(tusPrefix, tusHandler)
-	mux.Handle("/files/", limiter.Middleware(inlineDisposition(strippedTus)))
+	mux.HandleFunc("PATCH "+tusPrefix+"/{id}/expiry", s.handleUpdateExpiry)
+	mux.Handle("DELETE "+tusPrefix+"/{id}", s.requireManagementToken(strippedTus))
+	mux.Handle("/files/", limiter.Middleware(countUploadBytes(s.withEncryptionKey(s.serveDownloads(hidePrivateMetadata(strippedTus))))))
+
+	// Single-request uploads for curl and HTML forms, made through tusd.
+	s.uploads = countUploadBytes(s.withEncryptionKey(strippedTus))
+	mux.Handle("PUT /{filename}", limiter.Middleware(http.HandlerFunc(s.handlePut)))
+	mux.Handle("POST /upload", limiter.Middleware(http.HandlerFunc(s.handleFormUpload)))
+
+	s.handler = clientip.New(cfg).Handler(dropKeyParam(tracing.Handler(mux)))
+	return s
+}
 
-	return &Server{cfg: cfg, handler: mux}
+// dropKeyParam removes the key query parameter, in which share links used to
+// carry SSE-C keys, before the request is traced or handled. Keys are only
+// accepted in a header now (see withEncryptionKey), and one left in an old
+// link must not end up in a span or be passed on by a short-link redirect.
+func dropKeyParam(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Has("key") {
+			q.Del("key")
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = q.Encode()
+			r.RequestURI = r.URL.RequestURI()
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) Handler() http.Handler {
@@ -52,86 +135,171 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-// inlineDisposition wraps a handler and rewrites Content-Disposition from
-// "attachment" to "inline" on GET responses so that AI tools and browsers
-// render the file content directly instead of treating it as a binary download.
-// Pass ?dl=1 to force attachment (download) behaviour instead.
-func inlineDisposition(next http.Handler) http.Handler {
+// serveDownloads serves GET requests for uploads itself (see serveFile) and
+// passes everything else to tusd. Images, video, audio, PDFs and plain text
+// are shown inline so that browsers render them directly instead of
+// treating them as a download; pass ?dl=1 to force an attachment instead.
+// Every other type is an attachment, and active content such as HTML, SVG
+// and JavaScript is served as plain text (see contenttype.Serve).
+//
+// It also guards downloads: uploads must have passed the malware scan (see
+// checkScan), encrypted uploads require their key (see checkEncryptionKey),
+// password-protected uploads require the password (see checkPassword), and
+// each GET of an upload with a max-downloads limit consumes one download,
+// deleting the upload once the last one is served. Conditional requests
+// answered with 304 Not Modified consume none. With S3_PRESIGN_DOWNLOADS,
+// uploads that need none of these checks per request are redirected to S3
+// instead (see redirectDownload).
+func (s *Server) serveDownloads(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+		// The password form posts back to the download URL.
+		formPost := isPasswordForm(r)
+		if r.Method != http.MethodGet && !formPost {
 			next.ServeHTTP(w, r)
 			return
 		}
-		dl := r.URL.Query().Get("dl") == "1"
-		next.ServeHTTP(&inlineWriter{ResponseWriter: w, forceDownload: dl}, r)
-	})
-}
 
-// inlineWriter intercepts WriteHeader to rewrite Content-Disposition and
-// Content-Type before the response is sent. Go's http.ResponseWriter does not
-// allow header changes after WriteHeader, so we must intercept it.
-type inlineWriter struct {
-	http.ResponseWriter
-	forceDownload bool
-	wroteHeader   bool
-}
-
-func (w *inlineWriter) WriteHeader(code int) {
-	if !w.wroteHeader {
-		w.wroteHeader = true
-		h := w.ResponseWriter.Header()
-
-		if w.forceDownload {
-			// Ensure attachment regardless of what tusd set.
-			cd := h.Get("Content-Disposition")
-			if strings.HasPrefix(cd, "inline") {
-				h.Set("Content-Disposition", "attachment"+strings.TrimPrefix(cd, "inline"))
-			} else if cd == "" {
-				h.Set("Content-Disposition", "attachment")
-			}
-		} else {
-			// Rewrite attachment → inline so browsers and AI tools render inline.
-			cd := h.Get("Content-Disposition")
-			if strings.HasPrefix(cd, "attachment") {
-				h.Set("Content-Disposition", "inline"+strings.TrimPrefix(cd, "attachment"))
+		id := path.Base(r.URL.Path)
+		info, err := storage.ReadInfo(r.Context(), s.store, s.store.UploadKey(id))
+		if errors.Is(err, storage.ErrNotFound) {
+			// Let tusd answer with its usual 404.
+			if formPost {
+				r = asGet(r)
 			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			slog.Error("server: failed to read upload info", "upload_id", id, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		// On S3 the part after "+" in a tus ID does not select the upload,
+		// so many IDs reach the same one. Go on with the ID it was stored
+		// under, so that download counts, webhooks and logs agree.
+		id = info.ID
+
+		if !checkScan(w, info) {
+			return
+		}
+
+		// Browsers get an HTML page instead of the file; see below.
+		w.Header().Set("Vary", "Accept")
 
-			// Fix Content-Type when tusd falls back to binary/octet-stream.
-			// Uploaders often send the MIME type as "content-type" metadata key
-			// instead of the tusd-preferred "filetype" key.
-			ct := h.Get("Content-Type")
-			if ct == "application/octet-stream" || ct == "binary/octet-stream" {
-				meta := parseTusdMeta(h.Get("Upload-Metadata"))
-				if mime, ok := meta["filetype"]; ok && mime != "" {
-					h.Set("Content-Type", mime)
-				} else if mime, ok := meta["content-type"]; ok && mime != "" {
-					h.Set("Content-Type", mime)
+		// Browsers opening an end-to-end encrypted upload get the page that
+		// decrypts it; the page then fetches the ciphertext from this URL.
+		// Serving the page consumes no download.
+		if info.MetaData["e2e"] == "1" {
+			if !formPost && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				if chunk, err := strconv.Atoi(info.MetaData["e2e-chunk-size"]); err == nil && chunk > 0 {
+					ui.DecryptPage(w, chunk, info.MetaData["e2e-meta"])
+					return
 				}
 			}
 		}
-	}
-	w.ResponseWriter.WriteHeader(code)
+
+		if !checkEncryptionKey(w, r, info) {
+			return
+		}
+		if !s.checkPassword(w, r, id, info) {
+			return
+		}
+		if formPost {
+			r = asGet(r)
+		} else if wantsLandingPage(r) {
+			// Browsers opening a link get the landing page, which consumes
+			// no download.
+			s.landingPage(w, r, id, info)
+			return
+		}
+
+		contentType, inline := contenttype.Serve(info.MetaData)
+		attachment := !inline || r.URL.Query().Get("dl") == "1"
+		if s.redirectDownload(w, r, id, info, contentType, attachment) {
+			return
+		}
+
+		obj, ok := s.statUpload(w, r, id, info)
+		if !ok {
+			return
+		}
+		if notModified(r, obj) {
+			writeNotModified(w, obj)
+			return
+		}
+
+		// A limited upload is always sent whole: a player or download
+		// manager fetching one file in many ranges would otherwise use up
+		// the limit with pieces of a single download.
+		_, limited := downloads.Limit(info.MetaData)
+		if limited {
+			r.Header.Del("Range")
+			r.Header.Del("If-Range")
+		}
+
+		last, err := s.counter.Acquire(r.Context(), id, info)
+		if errors.Is(err, downloads.ErrExhausted) {
+			http.Error(w, "download limit reached", http.StatusGone)
+			return
+		}
+		if err != nil {
+			slog.Error("server: failed to count download", "upload_id", id, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		dw := &downloadWriter{ResponseWriter: w}
+		s.serveFile(dw, r, info, obj, contentType, attachment)
+		if dw.status == http.StatusOK || dw.status == http.StatusPartialContent {
+			metrics.Downloads.Inc()
+			metrics.BytesServed.Add(float64(dw.written))
+			s.notifyDownload(r, info)
+		}
+
+		if !limited {
+			return
+		}
+		// Drop the request's cancellation: the client may already have gone
+		// once it has the last byte.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 30*time.Second)
+		defer cancel()
+		if dw.written != info.Size {
+			// The download was cut short; give it back so that the
+			// recipient can try again.
+			if err := s.counter.Release(ctx, id, info); err != nil {
+				slog.Error("server: failed to give back interrupted download", "upload_id", id, "error", err)
+			}
+			return
+		}
+		if last {
+			if err := s.counter.Burn(ctx, id, info); err != nil {
+				slog.Error("server: failed to delete upload after final download", "upload_id", id, "error", err)
+				return
+			}
+			slog.Info("server: deleted upload after final download", "upload_id", id)
+		}
+	})
 }
 
-func (w *inlineWriter) Write(b []byte) (int, error) {
-	if !w.wroteHeader {
-		w.WriteHeader(http.StatusOK)
+// downloadWriter records the status and size of a download response.
+type downloadWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *downloadWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
 	}
-	return w.ResponseWriter.Write(b)
+	w.ResponseWriter.WriteHeader(code)
 }
 
-// parseTusdMeta decodes the Upload-Metadata header value (comma-separated
-// "key base64value" pairs) into a plain map.
-func parseTusdMeta(raw string) map[string]string {
-	m := make(map[string]string)
-	for _, pair := range strings.Split(raw, ",") {
-		pair = strings.TrimSpace(pair)
-		kv := strings.SplitN(pair, " ", 2)
-		if len(kv) == 2 {
-			if b, err := base64.StdEncoding.DecodeString(kv[1]); err == nil {
-				m[kv[0]] = string(b)
-			}
-		}
+func (w *downloadWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
 	}
-	return m
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
 }
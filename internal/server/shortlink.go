@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+)
+
+// handleShortLink redirects GET /s/{code} to the download URL of the upload
+// the code links to, keeping the query, so that ?dl=1 can be added to short
+// links too. Browsers keep the fragment across the redirect, and with it the
+// #key= of encrypted uploads. The download URL then applies all of its
+// checks.
+func (s *Server) handleShortLink(w http.ResponseWriter, r *http.Request) {
+	id, err := s.links.Resolve(r.Context(), r.PathValue("code"))
+	if errors.Is(err, shortlink.ErrNotFound) {
+		http.Error(w, "link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("server: failed to resolve short link", "code", r.PathValue("code"), "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The link may have outlived its upload if deleting it failed.
+	info, err := storage.ReadInfo(r.Context(), s.store, s.store.UploadKey(id))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("server: failed to read upload info", "upload_id", id, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	target := s.cfg.TUSBasePath + info.ID
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target, http.StatusFound)
+}
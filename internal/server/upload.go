@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/collection"
+	"sharemk/internal/contenttype"
+	"sharemk/internal/downloads"
+	"sharemk/internal/scan"
+	"sharemk/internal/shortlink"
+	"sharemk/internal/storage"
+)
+
+// uploadMetadataKeys are the tus metadata keys that single-request uploads
+// take from query parameters (PUT) or form fields (POST /upload).
+var uploadMetadataKeys = []string{
+	"expires-in",
+	"expires-at",
+	"max-downloads",
+	"password",
+	"encrypt",
+	"webhook-url",
+	collection.IDKey,
+	collection.TokenKey,
+	collection.PathKey,
+	shortlink.SlugKey,
+}
+
+// Bounds on the form fields sent before the file in POST /upload.
+const (
+	maxFormFields    = 32
+	maxFormFieldSize = 4096
+)
+
+// handlePut stores the request body as a new upload named after the last
+// path segment, so that curl -T report.pdf https://share.mk/ works:
+//
+//	PUT /report.pdf?expires-in=1h
+//
+// Metadata such as expires-in or max-downloads is given as query
+// parameters, the type as the Content-Type header.
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	meta := map[string]string{"filename": r.PathValue("filename")}
+	q := r.URL.Query()
+	for _, k := range uploadMetadataKeys {
+		if q.Has(k) {
+			meta[k] = q.Get(k)
+		}
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		meta["filetype"] = ct
+	}
+	s.upload(w, r, meta, r.Body, r.ContentLength)
+}
+
+// handleFormUpload stores the file of a multipart/form-data request as a new
+// upload, for HTML forms and curl -F:
+//
+//	POST /upload
+//	expires-in=1h, file=@report.pdf
+//
+// Metadata is given as form fields, which must come before the file. The
+// file is streamed to storage as it arrives; one file is stored per
+// request.
+func (s *Server) handleFormUpload(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "body must be multipart/form-data")
+		return
+	}
+
+	meta := map[string]string{}
+	for fields := 0; ; fields++ {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			writeJSONError(w, http.StatusBadRequest, "no file in the form; send it in a field with a filename")
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "malformed multipart body")
+			return
+		}
+
+		if part.FileName() != "" {
+			meta["filename"] = part.FileName()
+			if ct := part.Header.Get("Content-Type"); ct != "" {
+				meta["filetype"] = ct
+			}
+			s.upload(w, r, meta, part, -1)
+			return
+		}
+
+		if fields == maxFormFields {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("too many form fields; at most %d may precede the file", maxFormFields))
+			return
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "malformed multipart body")
+			return
+		}
+		if len(value) > maxFormFieldSize {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("form field %q must be at most %d bytes", part.FormName(), maxFormFieldSize))
+			return
+		}
+		if slices.Contains(uploadMetadataKeys, part.FormName()) {
+			meta[part.FormName()] = string(value)
+		}
+	}
+}
+
+// upload stores body as a new upload with metadata meta. It makes the same
+// tus requests a client would, creating the upload and sending its data in
+// one PATCH, so that the upload passes through the same hooks, checks,
+// encryption and storage as any other. size is -1 if the length of body is
+// not known up front; the length is then declared once body has ended.
+//
+// tusd's errors are passed on as they are. On success the response carries
+// the download URL and the management token.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, meta map[string]string, body io.Reader, size int64) {
+	create := s.tusRequest(r, http.MethodPost, s.cfg.TUSBasePath, nil)
+	create.Header.Set("Upload-Metadata", handler.SerializeMetadataHeader(meta))
+	if size >= 0 {
+		create.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	} else {
+		create.Header.Set("Upload-Defer-Length", "1")
+	}
+	res := s.tus(w, create)
+	if res.status != http.StatusCreated {
+		res.relay(w)
+		return
+	}
+	loc, err := url.Parse(res.header.Get("Location"))
+	if err != nil {
+		slog.Error("server: tusd returned an invalid location", "location", res.header.Get("Location"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	id := path.Base(loc.Path)
+	token := res.header.Get("Upload-Management-Token")
+	key := res.header.Get("Upload-Encryption-Key")
+
+	patch := s.tusRequest(r, http.MethodPatch, s.cfg.TUSBasePath+id, body)
+	patch.ContentLength = size
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch.Header.Set("Upload-Offset", "0")
+	if key != "" {
+		patch.Header.Set("X-Share-Key", key)
+	}
+	res = s.tus(w, patch)
+
+	if res.status == http.StatusNoContent && size < 0 {
+		// Now that the body has ended its length is known; declaring it
+		// completes the upload.
+		offset := res.header.Get("Upload-Offset")
+		finish := s.tusRequest(r, http.MethodPatch, s.cfg.TUSBasePath+id, nil)
+		finish.Header.Set("Content-Type", "application/offset+octet-stream")
+		finish.Header.Set("Upload-Offset", offset)
+		finish.Header.Set("Upload-Length", offset)
+		if key != "" {
+			finish.Header.Set("X-Share-Key", key)
+		}
+		res = s.tus(w, finish)
+	}
+	if res.status != http.StatusNoContent {
+		s.abandonUpload(w, r, id)
+		res.relay(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	info, err := storage.ReadInfo(ctx, s.store, s.store.UploadKey(id))
+	if err != nil {
+		slog.Error("server: failed to read upload info", "upload_id", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, s.uploadResult(info, token, key))
+}
+
+// uploadResult describes a completed upload in the same shape as the
+// upload_file MCP tool's result.
+func (s *Server) uploadResult(info handler.FileInfo, token, key string) map[string]any {
+	downloadURL := s.manager.DownloadURL(info.ID)
+	var shortURL string
+	if code := info.MetaData[shortlink.MetaKey]; code != "" {
+		shortURL = s.links.URL(code)
+	}
+	if key != "" {
+		downloadURL += "#key=" + key
+		if shortURL != "" {
+			shortURL += "#key=" + key
+		}
+	}
+	result := map[string]any{
+		"file_id":          info.ID,
+		"management_token": token,
+		"download_url":     downloadURL,
+		"filename":         info.MetaData["filename"],
+		"size_bytes":       info.Size,
+	}
+	if shortURL != "" {
+		result["short_url"] = shortURL
+	}
+	// HandleComplete tags the upload in the background; its expiry is
+	// resolved the same way.
+	if t, err := s.policy.Resolve(info.MetaData["expires-in"], info.MetaData["expires-at"], time.Now()); err == nil {
+		result["expires_at"] = t.Format(time.RFC3339)
+	}
+	if detected := info.MetaData[contenttype.MetaKey]; detected != "" {
+		result["detected_type"] = detected
+	}
+	if n, ok := downloads.Limit(info.MetaData); ok {
+		result["max_downloads"] = n
+	}
+	if info.MetaData["password-hash"] != "" {
+		result["password_protected"] = true
+	}
+	if key != "" {
+		result["encrypted"] = true
+		result["encryption_key"] = key
+	}
+	if status := info.MetaData[scan.StatusKey]; status != "" {
+		result["scan_status"] = status
+	}
+	if id := info.MetaData[collection.IDKey]; id != "" {
+		result["collection_id"] = id
+	}
+	return result
+}
+
+// abandonUpload terminates upload id after its data could not be stored, so
+// that no incomplete upload is left behind. The client may be gone already.
+// Uploads rejected on completion have been deleted by PreFinish.
+func (s *Server) abandonUpload(w http.ResponseWriter, r *http.Request, id string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 30*time.Second)
+	defer cancel()
+	req := s.tusRequest(r.WithContext(ctx), http.MethodDelete, s.cfg.TUSBasePath+id, nil)
+	if res := s.tus(w, req); res.status != http.StatusNoContent && res.status != http.StatusNotFound {
+		slog.Warn("server: failed to terminate abandoned upload", "upload_id", id, "status", res.status)
+	}
+}
+
+// forwardedHeaders are copied from a client's request to the tus requests
+// made on its behalf.
+var forwardedHeaders = []string{"User-Agent", "X-Forwarded-For", "X-Real-IP", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"}
+
+// tusRequest returns a tus request to target on behalf of client request r.
+func (s *Server) tusRequest(r *http.Request, method, target string, body io.Reader) *http.Request {
+	req, _ := http.NewRequestWithContext(r.Context(), method, target, body)
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for _, h := range forwardedHeaders {
+		if v := r.Header.Values(h); len(v) > 0 {
+			req.Header[h] = v
+		}
+	}
+	return req
+}
+
+// tus serves req with the tus handler and returns its response. w is the
+// client's response writer; tusd extends its connection deadlines while it
+// reads the data.
+func (s *Server) tus(w http.ResponseWriter, req *http.Request) *tusResponse {
+	res := &tusResponse{w: w, header: http.Header{}}
+	s.uploads.ServeHTTP(res, req)
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	return res
+}
+
+// tusResponse records tusd's response to a request made on a client's
+// behalf.
+type tusResponse struct {
+	w      http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (t *tusResponse) Header() http.Header {
+	return t.header
+}
+
+func (t *tusResponse) WriteHeader(code int) {
+	if t.status == 0 {
+		t.status = code
+	}
+}
+
+func (t *tusResponse) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	return t.body.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the client's connection.
+func (t *tusResponse) Unwrap() http.ResponseWriter {
+	return t.w
+}
+
+// relay writes the recorded response to the client.
+func (t *tusResponse) relay(w http.ResponseWriter) {
+	if ct := t.header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(t.status)
+	w.Write(t.body.Bytes()) //nolint:errcheck
+}
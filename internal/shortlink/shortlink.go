@@ -0,0 +1,206 @@
+// Package shortlink gives uploads short links of the form /s/{code}. Download
+// URLs carry the full tus ID, which is long and, for S3 uploads, contains a
+// "+" that some chat clients and mail gateways mangle.
+//
+// Each link is one small object holding the ID of its upload:
+//
+//	short/Xk3a9Qz → 3f2a…
+//
+// Links of tus uploads are created once all of the data has arrived, so
+// abandoned uploads hold none. The code is recorded in the upload's metadata
+// and in the tags of its data object, so the link is deleted together with
+// the upload, whether it expires or is deleted earlier; the expiry worker's
+// reconciliation deletes any link whose upload is gone all the same.
+package shortlink
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"sharemk/internal/config"
+	"sharemk/internal/storage"
+)
+
+// MetaKey is the metadata key, and tag, holding an upload's short code.
+// SlugKey is the metadata key an uploader asks for a slug of their own with.
+const (
+	MetaKey = "short-code"
+	SlugKey = "slug"
+)
+
+// Shape of generated codes and slugs.
+const (
+	alphabet    = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	codeLen     = 7
+	codeRetries = 5
+	minSlugLen  = 3
+	maxSlugLen  = 64
+)
+
+// ErrNotFound is returned for codes that do not exist.
+var ErrNotFound = errors.New("short link not found")
+
+// Errors for slugs that cannot be had. ErrInvalidSlug is wrapped with the
+// offending slug.
+var (
+	ErrTaken         = errors.New("slug is already taken")
+	ErrInvalidSlug   = errors.New("invalid slug")
+	ErrSlugsDisabled = errors.New("custom slugs are not enabled on this server")
+)
+
+type Links struct {
+	cfg   *config.Config
+	store storage.Backend
+}
+
+func New(cfg *config.Config, store storage.Backend) *Links {
+	return &Links{cfg: cfg, store: store}
+}
+
+// Create links a code to upload id: slug if it is set, or else a random
+// code that is not in use yet.
+func (l *Links) Create(ctx context.Context, slug, id string) (string, error) {
+	if slug != "" {
+		if err := l.checkSlug(slug); err != nil {
+			return "", err
+		}
+		if err := l.claim(ctx, slug, id); err != nil {
+			return "", err
+		}
+		return slug, nil
+	}
+
+	for range codeRetries {
+		code, err := randomCode()
+		if err != nil {
+			return "", err
+		}
+		err = l.claim(ctx, code, id)
+		if errors.Is(err, ErrTaken) {
+			continue
+		}
+		return code, err
+	}
+	return "", errors.New("shortlink: no free code found")
+}
+
+// Check returns the error Create would return for slug, unless another
+// upload claims it in the meantime. It lets tus uploads, whose link is only
+// created once their data has arrived, be refused before sending any.
+func (l *Links) Check(ctx context.Context, slug string) error {
+	if slug == "" {
+		return nil
+	}
+	if err := l.checkSlug(slug); err != nil {
+		return err
+	}
+	_, err := l.store.Stat(ctx, l.Key(slug))
+	switch {
+	case err == nil:
+		return ErrTaken
+	case errors.Is(err, storage.ErrNotFound):
+		return nil
+	}
+	return err
+}
+
+// checkSlug returns an error if uploaders may not choose slug.
+func (l *Links) checkSlug(slug string) error {
+	if !l.cfg.ShortLinkSlugs {
+		return ErrSlugsDisabled
+	}
+	if !validSlug(slug) {
+		return fmt.Errorf("%w %q; use %d to %d letters, digits, - or _, starting with a letter or digit", ErrInvalidSlug, slug, minSlugLen, maxSlugLen)
+	}
+	return nil
+}
+
+// claim writes the link from code to upload id unless code is in use. The
+// write is conditional, so of two uploads claiming the same code at once
+// only one gets it.
+func (l *Links) claim(ctx context.Context, code, id string) error {
+	err := l.store.Create(ctx, l.Key(code), strings.NewReader(id), int64(len(id)), "text/plain")
+	if errors.Is(err, storage.ErrExists) {
+		return ErrTaken
+	}
+	return err
+}
+
+// Resolve returns the ID of the upload code links to.
+func (l *Links) Resolve(ctx context.Context, code string) (string, error) {
+	if !validSlug(code) {
+		return "", ErrNotFound
+	}
+	body, err := l.store.Get(ctx, l.Key(code))
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	id, err := io.ReadAll(io.LimitReader(body, 256))
+	if err != nil {
+		return "", err
+	}
+	return string(id), nil
+}
+
+// Delete removes link code. An empty code is ignored.
+func (l *Links) Delete(ctx context.Context, code string) error {
+	if code == "" {
+		return nil
+	}
+	return l.store.Delete(ctx, l.Key(code))
+}
+
+// Key returns the key of the object holding link code.
+func (l *Links) Key(code string) string {
+	return l.cfg.ShortLinkPrefix + code
+}
+
+// URL returns the public URL of link code.
+func (l *Links) URL(code string) string {
+	return strings.TrimRight(l.cfg.PublicURL, "/") + "/s/" + code
+}
+
+// randomCode returns codeLen characters drawn uniformly from alphabet.
+func randomCode() (string, error) {
+	code := make([]byte, 0, codeLen)
+	buf := make([]byte, 2*codeLen)
+	for len(code) < codeLen {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// 248 is the largest multiple of 62 below 256; dropping larger
+			// bytes keeps every character equally likely.
+			if b < 248 && len(code) < codeLen {
+				code = append(code, alphabet[b%62])
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// validSlug reports whether s can be a code: generated codes and chosen slugs
+// alike, so that no other key can be reached through it.
+func validSlug(s string) bool {
+	if len(s) < minSlugLen || len(s) > maxSlugLen {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case (c == '-' || c == '_') && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
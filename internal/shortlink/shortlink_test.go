@@ -0,0 +1,149 @@
+package shortlink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"sharemk/internal/config"
+	"sharemk/internal/storage"
+)
+
+func newLinks(t *testing.T, slugs bool) *Links {
+	t.Helper()
+	cfg := &config.Config{
+		LocalStorageDir: t.TempDir(),
+		S3ObjectPrefix:  "uploads/",
+		ShortLinkPrefix: "short/",
+		ShortLinkSlugs:  slugs,
+		PublicURL:       "https://share.example/",
+	}
+	store, err := storage.NewLocal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg, store)
+}
+
+func TestValidSlug(t *testing.T) {
+	tests := []struct {
+		slug string
+		want bool
+	}{
+		{"abc", true},
+		{"q3-report", true},
+		{"Q3_Report_2026", true},
+		{"0a", false},
+		{strings.Repeat("a", maxSlugLen), true},
+		{strings.Repeat("a", maxSlugLen+1), false},
+		{"", false},
+		{"-abc", false},
+		{"_abc", false},
+		{"a/b", false},
+		{"../etc", false},
+		{"a.b", false},
+		{"a b", false},
+		{"ümlaut", false},
+	}
+	for _, tt := range tests {
+		if got := validSlug(tt.slug); got != tt.want {
+			t.Errorf("validSlug(%q) = %v, want %v", tt.slug, got, tt.want)
+		}
+	}
+}
+
+func TestRandomCode(t *testing.T) {
+	code, err := randomCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != codeLen || !validSlug(code) {
+		t.Errorf("randomCode() = %q, want %d characters from the alphabet", code, codeLen)
+	}
+}
+
+func TestCreateResolve(t *testing.T) {
+	ctx := context.Background()
+	l := newLinks(t, true)
+
+	code, err := l.Create(ctx, "", "upload-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := l.Resolve(ctx, code); err != nil || id != "upload-1" {
+		t.Errorf("Resolve(%q) = %q, %v; want upload-1", code, id, err)
+	}
+	if got, want := l.URL(code), "https://share.example/s/"+code; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+
+	if err := l.Delete(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Resolve(ctx, code); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve after Delete: %v, want ErrNotFound", err)
+	}
+	if _, err := l.Resolve(ctx, "../uploads/upload-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve of a path: %v, want ErrNotFound", err)
+	}
+}
+
+func TestCreateSlug(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := newLinks(t, false).Create(ctx, "q3-report", "upload-1"); !errors.Is(err, ErrSlugsDisabled) {
+		t.Errorf("Create with slugs disabled: %v, want ErrSlugsDisabled", err)
+	}
+
+	l := newLinks(t, true)
+	if _, err := l.Create(ctx, "a/b", "upload-1"); !errors.Is(err, ErrInvalidSlug) {
+		t.Errorf("Create with invalid slug: %v, want ErrInvalidSlug", err)
+	}
+	code, err := l.Create(ctx, "q3-report", "upload-1")
+	if err != nil || code != "q3-report" {
+		t.Fatalf("Create = %q, %v; want q3-report", code, err)
+	}
+	if _, err := l.Create(ctx, "q3-report", "upload-2"); !errors.Is(err, ErrTaken) {
+		t.Errorf("Create with taken slug: %v, want ErrTaken", err)
+	}
+	if id, _ := l.Resolve(ctx, "q3-report"); id != "upload-1" {
+		t.Errorf("taken slug now links to %q, want upload-1", id)
+	}
+}
+
+func TestCreateSlugConcurrent(t *testing.T) {
+	ctx := context.Background()
+	l := newLinks(t, true)
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		winner string
+		wins   int
+	)
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := l.Create(ctx, "contested", id)
+			if err == nil {
+				mu.Lock()
+				winner = id
+				wins++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrTaken) {
+				t.Errorf("Create: %v, want nil or ErrTaken", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if wins != 1 {
+		t.Fatalf("%d uploads claimed the slug, want 1", wins)
+	}
+	if id, _ := l.Resolve(ctx, "contested"); id != winner {
+		t.Errorf("slug links to %q, want the winner %q", id, winner)
+	}
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/tus/tusd/v2/pkg/filestore"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/config"
+)
+
+// tagsSuffix names the sidecar file that holds an object's tags, since a
+// plain filesystem has nothing equivalent to S3 object tagging.
+const tagsSuffix = ".tags"
+
+// Local stores uploads on the local filesystem via tusd's filestore.
+type Local struct {
+	root   string
+	prefix string
+}
+
+// NewLocal returns a backend rooted at cfg.LocalStorageDir, creating the
+// upload directory if it does not exist yet.
+func NewLocal(cfg *config.Config) (*Local, error) {
+	root, err := filepath.Abs(cfg.LocalStorageDir)
+	if err != nil {
+		return nil, err
+	}
+	b := &Local{root: root, prefix: cfg.S3ObjectPrefix}
+	if err := os.MkdirAll(b.uploadDir(), filestore.DefaultDirPerm); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Local) UseIn(composer *handler.StoreComposer) {
+	filestore.New(b.uploadDir()).UseIn(composer)
+}
+
+// UploadKey maps a tus ID to its file, which filestore names after the full ID.
+func (b *Local) UploadKey(id string) string {
+	return b.prefix + id
+}
+
+func (b *Local) StorageInfo(key string) map[string]string {
+	return map[string]string{
+		"Type":                       "filestore",
+		filestore.StorageKeyPath:     b.path(key),
+		filestore.StorageKeyInfoPath: b.path(key) + ".info",
+	}
+}
+
+func (b *Local) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	p := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), filestore.DefaultDirPerm); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never observe a partially
+	// written object.
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), filestore.DefaultFilePerm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (b *Local) Create(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	p := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), filestore.DefaultDirPerm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filestore.DefaultFilePerm)
+	if errors.Is(err, fs.ErrExist) {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(p)
+		return err
+	}
+	return nil
+}
+
+func (b *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(b.path(key))
+	if err != nil {
+		return nil, mapPathError(err)
+	}
+	return f, nil
+}
+
+func (b *Local) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(b.path(key))
+	if err != nil {
+		return nil, mapPathError(err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (b *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	fi, err := os.Stat(b.path(key))
+	if err != nil {
+		return ObjectInfo{}, mapPathError(err)
+	}
+	return fileObjectInfo(key, fi), nil
+}
+
+func (b *Local) GetTags(ctx context.Context, key string) (map[string]string, error) {
+	if _, err := os.Stat(b.path(key)); err != nil {
+		return nil, mapPathError(err)
+	}
+
+	tags := make(map[string]string)
+	data, err := os.ReadFile(b.path(key) + tagsSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return tags, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (b *Local) SetTags(ctx context.Context, key string, tags map[string]string) error {
+	if _, err := os.Stat(b.path(key)); err != nil {
+		return mapPathError(err)
+	}
+
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return b.Put(ctx, key+tagsSuffix, bytes.NewReader(data), int64(len(data)), "application/json")
+}
+
+func (b *Local) Delete(ctx context.Context, keys ...string) error {
+	for _, k := range keys {
+		for _, p := range []string{b.path(k), b.path(k) + tagsSuffix} {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		b.pruneDirs(filepath.Dir(b.path(k)))
+	}
+	return nil
+}
+
+// pruneDirs removes dir and its parents while they are empty, mirroring S3
+// where "directories" disappear with their last object. The root and the
+// upload directory are always kept.
+func (b *Local) pruneDirs(dir string) {
+	for dir != b.root && dir != b.uploadDir() && strings.HasPrefix(dir, b.root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (b *Local) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	// Only walk the deepest directory that fully contains the prefix.
+	dir := b.root
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		dir = b.path(prefix[:i])
+	}
+
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// The directory does not exist (yet) or the file vanished
+			// mid-walk; either way there is nothing to report.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, tagsSuffix) || strings.HasPrefix(path.Base(key), ".") {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(fileObjectInfo(key, fi))
+	})
+}
+
+// fileObjectInfo describes the file fi stored under key. Like most web
+// servers, it derives the ETag from the modification time and size.
+func fileObjectInfo(key string, fi fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+		ETag:         fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+	}
+}
+
+// uploadDir is the directory filestore writes uploads to.
+func (b *Local) uploadDir() string {
+	return b.path(b.prefix)
+}
+
+// path converts a key to an absolute filesystem path below the root. Keys
+// are cleaned as if rooted so that "../" segments cannot escape the root.
+func (b *Local) path(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// mapPathError translates missing files into ErrNotFound.
+func mapPathError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b *Local) Ping(ctx context.Context) error {
+	fi, err := os.Stat(b.uploadDir())
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("storage: %s is not a directory", b.uploadDir())
+	}
+	return nil
+}
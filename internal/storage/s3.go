@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/s3store"
+	"sharemk/internal/config"
+	"sharemk/internal/s3client"
+)
+
+// deleteBatchSize is the maximum number of keys accepted by DeleteObjects.
+const deleteBatchSize = 1000
+
+// S3 stores uploads in an S3-compatible bucket via tusd's s3store.
+type S3 struct {
+	client  *sseClient
+	presign *s3.PresignClient
+	bucket  string
+	prefix  string
+}
+
+// NewS3 builds an S3 client from cfg and returns a backend using it.
+func NewS3(cfg *config.Config) (*S3, error) {
+	client, err := s3client.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &S3{
+		client:  &sseClient{Client: client, prefix: cfg.S3ObjectPrefix},
+		presign: s3.NewPresignClient(client),
+		bucket:  cfg.S3Bucket,
+		prefix:  cfg.S3ObjectPrefix,
+	}, nil
+}
+
+func (b *S3) UseIn(composer *handler.StoreComposer) {
+	store := s3store.New(b.bucket, b.client)
+	store.ObjectPrefix = b.prefix
+	store.UseIn(composer)
+}
+
+// UploadKey strips the multipart ID from an "objectId+multipartId" tus ID.
+func (b *S3) UploadKey(id string) string {
+	objectId := id
+	if i := strings.IndexByte(id, '+'); i >= 0 {
+		objectId = id[:i]
+	}
+	return b.prefix + objectId
+}
+
+func (b *S3) StorageInfo(key string) map[string]string {
+	return map[string]string{
+		"Type":   "s3store",
+		"Bucket": b.bucket,
+		"Key":    key,
+	}
+}
+
+func (b *S3) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	})
+	return err
+}
+
+// Create writes with If-None-Match: *, which the provider must support (AWS
+// S3, MinIO, Cloudflare R2 and others do).
+func (b *S3) Create(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+		IfNoneMatch:   aws.String("*"),
+	})
+	return mapError(err)
+}
+
+func (b *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return out.Body, nil
+}
+
+func (b *S3) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return out.Body, nil
+}
+
+// PresignGet signs a GetObject request. It cannot be used for SSE-C
+// objects, whose key the client would have to send as headers.
+func (b *S3) PresignGet(ctx context.Context, key string, ttl time.Duration, contentType, disposition string) (string, error) {
+	req, err := b.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(b.bucket),
+		Key:                        aws.String(key),
+		ResponseContentType:        aws.String(contentType),
+		ResponseContentDisposition: aws.String(disposition),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (b *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, mapError(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		LastModified: aws.ToTime(out.LastModified),
+		ETag:         aws.ToString(out.ETag),
+	}, nil
+}
+
+func (b *S3) GetTags(ctx context.Context, key string) (map[string]string, error) {
+	out, err := b.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, t := range out.TagSet {
+		tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+	}
+	return tags, nil
+}
+
+func (b *S3) SetTags(ctx context.Context, key string, tags map[string]string) error {
+	tagSet := make([]s3types.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, s3types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err := b.client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(b.bucket),
+		Key:     aws.String(key),
+		Tagging: &s3types.Tagging{TagSet: tagSet},
+	})
+	return mapError(err)
+}
+
+func (b *S3) Delete(ctx context.Context, keys ...string) error {
+	for len(keys) > 0 {
+		n := min(len(keys), deleteBatchSize)
+		objects := make([]s3types.ObjectIdentifier, n)
+		for i, k := range keys[:n] {
+			objects[i] = s3types.ObjectIdentifier{Key: aws.String(k)}
+		}
+		keys = keys[n:]
+
+		_, err := b.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(b.bucket),
+			Delete: &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *S3) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			err := fn(ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+				ETag:         aws.ToString(obj.ETag),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *S3) Ping(ctx context.Context) error {
+	_, err := b.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(b.bucket)})
+	return err
+}
+
+// mapError translates S3 "not found" responses into ErrNotFound, and failed
+// If-None-Match conditions into ErrExists.
+func mapError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return ErrNotFound
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrExists
+		}
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+// Package storage abstracts the object store that holds uploads so that the
+// hooks, expiry worker and MCP server do not depend on S3 directly.
+//
+// Keys are slash-separated paths relative to the root of the store (the
+// bucket for S3, the storage directory for the local backend). Uploads live
+// under the configured object prefix: the data object at prefix+objectId and
+// tusd's metadata at prefix+objectId+".info".
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/config"
+)
+
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrExists is returned by Create when an object already exists.
+var ErrExists = errors.New("storage: object already exists")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// ETag is a quoted entity tag that changes whenever the object does.
+	ETag string
+}
+
+// Backend is implemented by every storage backend.
+type Backend interface {
+	// UseIn registers the matching tusd data store in the composer.
+	UseIn(composer *handler.StoreComposer)
+
+	// UploadKey converts a tus upload ID to the key of its data object.
+	UploadKey(id string) string
+
+	// StorageInfo returns the FileInfo.Storage map tusd expects in the .info
+	// object of an upload whose data object is stored at key.
+	StorageInfo(key string) map[string]string
+
+	// Put stores body under key, replacing any existing object.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+
+	// Create stores body under key unless an object already exists there,
+	// in which case it returns ErrExists. Of several concurrent calls for
+	// the same key, at most one succeeds.
+	Create(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+
+	// Get opens the object stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// GetRange opens length bytes of the object stored under key, starting
+	// at offset. The caller must close it.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+
+	// Stat returns information about the object stored under key.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+
+	// GetTags returns the tags attached to the object stored under key.
+	GetTags(ctx context.Context, key string) (map[string]string, error)
+
+	// SetTags replaces the tags attached to the object stored under key.
+	SetTags(ctx context.Context, key string, tags map[string]string) error
+
+	// Delete removes the given objects. Missing objects are not an error.
+	Delete(ctx context.Context, keys ...string) error
+
+	// List calls fn for every object whose key starts with prefix. Listing
+	// stops at the first error returned by fn.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+
+	// Ping checks that the store is reachable with the configured
+	// credentials, without reading or writing any object.
+	Ping(ctx context.Context) error
+}
+
+// Presigner is implemented by backends that can hand out URLs from which
+// clients read an object directly, without going through this server.
+type Presigner interface {
+	// PresignGet returns a URL that serves the object stored under key
+	// until ttl has passed, with the given Content-Type and
+	// Content-Disposition response headers.
+	PresignGet(ctx context.Context, key string, ttl time.Duration, contentType, disposition string) (string, error)
+}
+
+// UploadObjects returns the keys of every object belonging to the upload
+// whose data object is stored at key: the data itself, tusd's .info and the
+// download counter kept for uploads with a download limit.
+func UploadObjects(key string) []string {
+	return []string{key, key + ".info", key + ".downloads"}
+}
+
+// ReadInfo loads the tusd .info object of the upload whose data object is
+// stored at key.
+func ReadInfo(ctx context.Context, b Backend, key string) (handler.FileInfo, error) {
+	body, err := b.Get(ctx, key+".info")
+	if err != nil {
+		return handler.FileInfo{}, err
+	}
+	defer body.Close()
+
+	var info handler.FileInfo
+	if err := json.NewDecoder(body).Decode(&info); err != nil {
+		return handler.FileInfo{}, err
+	}
+	return info, nil
+}
+
+// WriteInfo replaces the .info object of the upload whose data object is
+// stored at key. The object's tags are kept.
+func WriteInfo(ctx context.Context, b Backend, key string, info handler.FileInfo) error {
+	tags, err := b.GetTags(ctx, key+".info")
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(ctx, key+".info", bytes.NewReader(data), int64(len(data)), "application/json"); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return b.SetTags(ctx, key+".info", tags)
+}
+
+// New returns the backend selected by cfg.StorageBackend.
+func New(cfg *config.Config) (Backend, error) {
+	switch cfg.StorageBackend {
+	case "s3":
+		return NewS3(cfg)
+	case "local":
+		return NewLocal(cfg)
+	default:
+		return nil, fmt.Errorf("storage: unknown backend %q", cfg.StorageBackend)
+	}
+}
@@ -0,0 +1,110 @@
+// Package tracing sets up OpenTelemetry tracing and provides the spans used
+// across the server: incoming HTTP requests, tus hooks, MCP tool calls,
+// expiry runs and S3 calls.
+//
+// Tracing is off unless an OTLP endpoint is configured; the global tracer
+// provider then stays a no-op and spans cost next to nothing. The standard
+// OTEL_* environment variables (OTEL_EXPORTER_OTLP_HEADERS,
+// OTEL_TRACES_SAMPLER, OTEL_SERVICE_NAME, ...) are honoured.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+	"sharemk/internal/clientip"
+	"sharemk/internal/config"
+)
+
+const instrumentation = "sharemk"
+
+// Setup installs the global tracer provider if cfg.OTLPEndpoint is set. The
+// exporter reads the endpoint itself from OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT. The returned function flushes pending
+// spans and must be called on shutdown.
+func Setup(ctx context.Context, cfg *config.Config, version string) (func(context.Context) error, error) {
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName("sharemk"),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over the defaults.
+	env, err := resource.New(ctx, resource.WithFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	if res, err = resource.Merge(res, env); err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// Start starts a span named name as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// End records err on span, if not nil, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler traces every request served by mux. Spans are named after the
+// matched route pattern, such as "GET /api/v1/files/{id}", rather than the
+// path, which would put upload IDs into span names.
+//
+// otelhttp records the leftmost X-Forwarded-For entry as the client's
+// address, which anyone can set; it is replaced with the address resolved by
+// clientip.
+func Handler(mux *http.ServeMux) http.Handler {
+	withClient := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(semconv.ClientAddress(clientip.Host(r.RemoteAddr)))
+		mux.ServeHTTP(w, r)
+	})
+	return otelhttp.NewHandler(withClient, "http", otelhttp.WithSpanNameFormatter(spanName))
+}
+
+// spanName is called once before routing and again afterwards, when the
+// mux has set r.Pattern.
+func spanName(_ string, r *http.Request) string {
+	if r.Pattern == "" {
+		return r.Method
+	}
+	method, route, found := strings.Cut(r.Pattern, " ")
+	if !found {
+		method, route = r.Method, r.Pattern
+	}
+	return method + " " + route
+}
@@ -2,15 +2,218 @@ package ui
 
 import (
 	_ "embed"
+	"fmt"
+	"html/template"
 	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
 )
 
 //go:embed index.html
 var indexHTML []byte
 
+//go:embed password.html
+var passwordHTML string
+
+var passwordTmpl = template.Must(template.New("password").Parse(passwordHTML))
+
+//go:embed decrypt.html
+var decryptHTML string
+
+var decryptTmpl = template.Must(template.New("decrypt").Parse(decryptHTML))
+
+//go:embed landing.html
+var landingHTML string
+
+var landingTmpl = template.Must(template.New("landing").Funcs(template.FuncMap{"size": formatSize}).Parse(landingHTML))
+
+//go:embed collection.html
+var collectionHTML string
+
+var collectionTmpl = template.Must(template.New("collection").Funcs(template.FuncMap{"size": formatSize}).Parse(collectionHTML))
+
+// textPreviewLimit is how much of a text file the landing page shows.
+const textPreviewLimit = 64 << 10
+
 func Handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Write(indexHTML) //nolint:errcheck
 	})
 }
+
+// PasswordPage renders the form that asks for a download password. The form
+// posts back to the download URL.
+func PasswordPage(w http.ResponseWriter, status int, filename, errMsg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	passwordTmpl.Execute(w, struct{ Filename, Error string }{filename, errMsg}) //nolint:errcheck
+}
+
+// DecryptPage renders the page that downloads an end-to-end encrypted upload
+// and decrypts it in the browser with the key from the URL fragment.
+// chunkSize is the plaintext chunk size and meta the sealed name and type,
+// both as recorded in the upload's metadata.
+func DecryptPage(w http.ResponseWriter, chunkSize int, meta string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	decryptTmpl.Execute(w, struct { //nolint:errcheck
+		ChunkSize int
+		Meta      string
+	}{chunkSize, meta})
+}
+
+// Landing is what the landing page shows about an upload.
+type Landing struct {
+	Filename     string
+	ContentType  string
+	Size         int64
+	ExpiresAt    time.Time
+	MaxDownloads int
+	// Encrypted uploads are fetched by the page with the key from the
+	// link's fragment, since a plain link to the file would lack it.
+	Encrypted bool
+	// DownloadURL downloads the file as an attachment.
+	DownloadURL string
+	// PreviewURL serves the file itself, for the preview.
+	PreviewURL string
+	// Preview is "image", "video", "audio", "pdf", "text", or "" for none.
+	Preview string
+	// Language is the highlight.js language of a text preview, if known.
+	Language string
+	// QRCode is an SVG image of the link to the page.
+	QRCode template.HTML
+}
+
+// TextPreviewLimit is how much of a text file the preview shows.
+func (Landing) TextPreviewLimit() int64 { return textPreviewLimit }
+
+// LandingPage renders the page browsers get when they open a download link:
+// what the file is, when the link expires, a download button, a QR code of
+// the link, and a preview where the browser can show the file.
+func LandingPage(w http.ResponseWriter, l Landing) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	landingTmpl.Execute(w, l) //nolint:errcheck
+}
+
+// Collection is what the collection page shows.
+type Collection struct {
+	Name      string
+	ExpiresAt time.Time
+	// ZipURL downloads all available files as one zip archive.
+	ZipURL string
+	// QRCode is an SVG image of the link to the page.
+	QRCode template.HTML
+	Files  []CollectionFile
+}
+
+// CollectionFile is one file listed on the collection page.
+type CollectionFile struct {
+	// Path is the file's name within the collection; files uploaded as
+	// part of a folder have slash-separated paths such as "icons/a.png".
+	Path        string
+	ContentType string
+	Size        int64
+	// URL opens the file's landing page.
+	URL string
+	// Unavailable says why the file cannot be downloaded yet, if it cannot.
+	Unavailable string
+}
+
+// Name is the last element of the file's path.
+func (f CollectionFile) Name() string {
+	return path.Base(f.Path)
+}
+
+// Dir is a folder in the tree view of a collection.
+type Dir struct {
+	Name  string
+	Dirs  []*Dir
+	Files []CollectionFile
+}
+
+// Size is the combined size of the files in d and its subfolders.
+func (d *Dir) Size() int64 {
+	var n int64
+	for _, sub := range d.Dirs {
+		n += sub.Size()
+	}
+	for _, f := range d.Files {
+		n += f.Size
+	}
+	return n
+}
+
+// Tree arranges the files into folders by their paths, sorted by name.
+func (c Collection) Tree() *Dir {
+	root := &Dir{}
+	for _, f := range c.Files {
+		d := root
+		elems := strings.Split(f.Path, "/")
+		for _, name := range elems[:len(elems)-1] {
+			d = d.subdir(name)
+		}
+		d.Files = append(d.Files, f)
+	}
+	root.sort()
+	return root
+}
+
+// subdir returns the subfolder of d called name, creating it if needed.
+func (d *Dir) subdir(name string) *Dir {
+	for _, sub := range d.Dirs {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	sub := &Dir{Name: name}
+	d.Dirs = append(d.Dirs, sub)
+	return sub
+}
+
+func (d *Dir) sort() {
+	slices.SortFunc(d.Dirs, func(a, b *Dir) int { return strings.Compare(a.Name, b.Name) })
+	slices.SortFunc(d.Files, func(a, b CollectionFile) int { return strings.Compare(a.Path, b.Path) })
+	for _, sub := range d.Dirs {
+		sub.sort()
+	}
+}
+
+// TotalSize is the combined size of the files.
+func (c Collection) TotalSize() int64 {
+	var n int64
+	for _, f := range c.Files {
+		n += f.Size
+	}
+	return n
+}
+
+// CollectionPage renders the page browsers get when they open a collection
+// link: the files in it as a folder tree, each linking to its landing page,
+// and a button that downloads all of them as a zip.
+func CollectionPage(w http.ResponseWriter, c Collection) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	collectionTmpl.Execute(w, c) //nolint:errcheck
+}
+
+// formatSize renders n bytes with a binary unit, e.g. "1.5 MiB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
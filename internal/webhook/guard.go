@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// errForbiddenAddress is returned when a per-upload webhook resolves to an
+// address that is not publicly routable.
+var errForbiddenAddress = errors.New("webhook: destination address is not allowed")
+
+// sharedAddressSpace is the carrier-grade NAT range, which net/netip does not
+// count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// newGuardedClient returns the client for per-upload webhooks. Anyone who can
+// upload chooses those URLs, so the client refuses to connect to loopback,
+// private and link-local addresses (such as cloud metadata endpoints),
+// checked on the address actually dialled so DNS tricks do not help. It
+// ignores proxy settings and does not follow redirects.
+func newGuardedClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddr(ap.Addr()) {
+				return errForbiddenAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: deliveryTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func publicAddr(a netip.Addr) bool {
+	a = a.Unmap()
+	return a.IsGlobalUnicast() &&
+		!a.IsPrivate() &&
+		!sharedAddressSpace.Contains(a)
+}
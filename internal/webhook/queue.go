@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"sharemk/internal/storage"
+)
+
+// Queue entries are stored as "<prefix><due unix seconds, 12 digits>-<id>",
+// so a listing returns them in due order and can stop at the first entry
+// that is not due yet.
+
+func (n *Notifier) queueKey(due time.Time, id string) string {
+	return fmt.Sprintf("%s%012d-%s", n.prefix, due.Unix(), id)
+}
+
+func (n *Notifier) parseQueueKey(key string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(key, n.prefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// retryDelay returns the wait before the attempt following attempt.
+func retryDelay(attempt int) time.Duration {
+	d := firstRetry << (attempt - 1)
+	if d <= 0 || d > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return d
+}
+
+// enqueue stores d for another attempt after its backoff delay.
+func (n *Notifier) enqueue(ctx context.Context, d delivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	key := n.queueKey(time.Now().Add(retryDelay(d.Attempt)), d.ID)
+	return n.store.Put(ctx, key, bytes.NewReader(b), int64(len(b)), "application/json")
+}
+
+// Start retries queued deliveries until ctx is cancelled. When several
+// replicas share the queue, an entry may be retried by more than one of
+// them.
+func (n *Notifier) Start(ctx context.Context) {
+	ticker := time.NewTicker(queueInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.runQueue(ctx)
+		}
+	}
+}
+
+// runQueue retries every queued delivery that is due.
+func (n *Notifier) runQueue(ctx context.Context) {
+	now := time.Now()
+	var due []string
+	err := n.store.List(ctx, n.prefix, func(obj storage.ObjectInfo) error {
+		t, ok := n.parseQueueKey(obj.Key)
+		if !ok {
+			return nil
+		}
+		if t.After(now) {
+			return errStopListing
+		}
+		due = append(due, obj.Key)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopListing) {
+		slog.Error("webhook: failed to list retry queue", "error", err)
+		return
+	}
+
+	for _, key := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		n.retry(ctx, key)
+	}
+}
+
+func (n *Notifier) retry(ctx context.Context, key string) {
+	d, err := n.load(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Retried by another replica in the meantime.
+		return
+	}
+	if err != nil {
+		slog.Error("webhook: failed to read queued delivery", "key", key, "error", err)
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, deliveryTimeout+5*time.Second)
+	err = n.send(sendCtx, d)
+	cancel()
+
+	switch {
+	case err == nil:
+		slog.Info("webhook: delivered after retry", "delivery_id", d.ID, "event", d.EventType, "attempt", d.Attempt+1)
+	case d.Attempt+1 >= maxAttempts || errors.Is(err, errForbiddenAddress):
+		slog.Error("webhook: giving up on delivery", "delivery_id", d.ID, "event", d.EventType, "url", d.URL, "error", err)
+	default:
+		d.Attempt++
+		slog.Warn("webhook: retry failed", "delivery_id", d.ID, "event", d.EventType, "attempt", d.Attempt, "error", err)
+		if err := n.enqueue(ctx, d); err != nil {
+			// Keep the old entry; it is retried on the next run.
+			slog.Error("webhook: failed to requeue delivery", "delivery_id", d.ID, "error", err)
+			return
+		}
+	}
+
+	if err := n.store.Delete(ctx, key); err != nil {
+		slog.Error("webhook: failed to remove queued delivery", "key", key, "error", err)
+	}
+}
+
+func (n *Notifier) load(ctx context.Context, key string) (delivery, error) {
+	body, err := n.store.Get(ctx, key)
+	if err != nil {
+		return delivery{}, err
+	}
+	defer body.Close()
+
+	var d delivery
+	err = json.NewDecoder(body).Decode(&d)
+	return d, err
+}
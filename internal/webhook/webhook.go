@@ -0,0 +1,258 @@
+// Package webhook notifies external services about upload lifecycle events
+// with signed JSON POST requests.
+//
+// Events go to the URLs in WEBHOOK_URLS and, when WEBHOOK_PER_UPLOAD is on,
+// to the URL an uploader set in the webhook-url metadata key. Each request
+// carries an HMAC-SHA256 signature: with WEBHOOK_SECRET for configured URLs,
+// and with the upload's management token for per-upload URLs, which only
+// the uploader knows.
+//
+// A delivery is attempted right away. If it fails it is written to a retry
+// queue in the storage backend and retried with exponential backoff, so
+// retries survive restarts. Delivery is at least once; receivers should
+// ignore deliveries whose X-Share-Delivery ID they have already seen.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"sharemk/internal/config"
+	"sharemk/internal/storage"
+)
+
+// Event types.
+const (
+	UploadCreated    = "upload.created"
+	UploadCompleted  = "upload.completed"
+	UploadDownloaded = "upload.downloaded"
+	UploadDeleted    = "upload.deleted"
+	UploadExpired    = "upload.expired"
+)
+
+// URLKey is the Upload-Metadata key holding a per-upload webhook URL.
+const URLKey = "webhook-url"
+
+const (
+	// maxAttempts is the number of attempts before a delivery is dropped.
+	// With the delays below the last one happens about 3.5 hours after the
+	// event.
+	maxAttempts   = 10
+	firstRetry    = 30 * time.Second
+	maxRetryDelay = time.Hour
+
+	deliveryTimeout = 10 * time.Second
+	queueInterval   = 30 * time.Second
+	maxConcurrent   = 8
+)
+
+// errStopListing ends a queue listing once an entry in the future is reached.
+var errStopListing = errors.New("webhook: stop listing")
+
+// Event is the JSON body of a webhook request.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	File      File      `json:"file"`
+}
+
+// File describes the upload an event is about.
+type File struct {
+	FileID      string `json:"file_id"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SizeBytes   int64  `json:"size_bytes"`
+	DownloadURL string `json:"download_url"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+}
+
+// delivery is one event bound for one URL. Failed deliveries are stored in
+// the retry queue as JSON.
+type delivery struct {
+	ID        string          `json:"id"`
+	EventType string          `json:"event_type"`
+	URL       string          `json:"url"`
+	PerUpload bool            `json:"per_upload,omitempty"`
+	Secret    string          `json:"secret,omitempty"`
+	Attempt   int             `json:"attempt"`
+	Body      json.RawMessage `json:"body"`
+}
+
+type Notifier struct {
+	store       storage.Backend
+	urls        []string
+	secret      string
+	perUpload   bool
+	prefix      string
+	downloadURL string
+
+	client  *http.Client
+	guarded *http.Client
+	sem     chan struct{}
+}
+
+func New(cfg *config.Config, store storage.Backend) *Notifier {
+	return &Notifier{
+		store:       store,
+		urls:        cfg.WebhookURLs,
+		secret:      cfg.WebhookSecret,
+		perUpload:   cfg.WebhookPerUpload,
+		prefix:      cfg.WebhookQueuePrefix,
+		downloadURL: strings.TrimRight(cfg.PublicURL, "/") + cfg.TUSBasePath,
+		client:      &http.Client{Timeout: deliveryTimeout},
+		guarded:     newGuardedClient(),
+		sem:         make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Enabled reports whether events can be delivered anywhere. Callers can skip
+// work that only serves webhooks when it is false.
+func (n *Notifier) Enabled() bool {
+	return len(n.urls) > 0 || n.perUpload
+}
+
+// Notify sends an event of type typ about the upload described by info to
+// every interested URL. It does not block. expiresAt is included if known.
+func (n *Notifier) Notify(typ string, info handler.FileInfo, expiresAt time.Time) {
+	if !n.Enabled() {
+		return
+	}
+
+	var targets []delivery
+	for _, u := range n.urls {
+		targets = append(targets, delivery{URL: u})
+	}
+	if u := info.MetaData[URLKey]; n.perUpload && u != "" && info.MetaData["mgmt-token"] != "" {
+		targets = append(targets, delivery{URL: u, PerUpload: true, Secret: info.MetaData["mgmt-token"]})
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	event := Event{
+		ID:        uuid.NewString(),
+		Type:      typ,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		File: File{
+			FileID:      info.ID,
+			Filename:    info.MetaData["filename"],
+			ContentType: info.MetaData["filetype"],
+			SizeBytes:   info.Size,
+			DownloadURL: n.downloadURL + info.ID,
+		},
+	}
+	if !expiresAt.IsZero() {
+		event.File.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("webhook: failed to encode event", "type", typ, "error", err)
+		return
+	}
+
+	for _, d := range targets {
+		d.ID = uuid.NewString()
+		d.EventType = typ
+		d.Body = body
+		go n.deliverNow(d)
+	}
+}
+
+// deliverNow makes the first attempt at d and queues it for a retry if that
+// fails.
+func (n *Notifier) deliverNow(d delivery) {
+	n.sem <- struct{}{}
+	defer func() { <-n.sem }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout+5*time.Second)
+	defer cancel()
+
+	d.Attempt = 1
+	err := n.send(ctx, d)
+	if err == nil {
+		return
+	}
+	if errors.Is(err, errForbiddenAddress) {
+		// Retrying would not change where the URL points.
+		slog.Warn("webhook: delivery blocked", "delivery_id", d.ID, "event", d.EventType, "error", err)
+		return
+	}
+	slog.Warn("webhook: delivery failed, will retry", "delivery_id", d.ID, "event", d.EventType, "error", err)
+	if err := n.enqueue(ctx, d); err != nil {
+		slog.Error("webhook: failed to queue delivery for retry", "delivery_id", d.ID, "error", err)
+	}
+}
+
+// send POSTs the delivery body, signed, and expects a 2xx response.
+func (n *Notifier) send(ctx context.Context, d delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+
+	secret := d.Secret
+	if !d.PerUpload {
+		secret = n.secret
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "share.mk-webhook")
+	req.Header.Set("X-Share-Event", d.EventType)
+	req.Header.Set("X-Share-Delivery", d.ID)
+	req.Header.Set("X-Share-Timestamp", ts)
+	req.Header.Set("X-Share-Signature", "sha256="+Sign(secret, ts, d.Body))
+
+	client := n.client
+	if d.PerUpload {
+		client = n.guarded
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: %s responded %s", d.URL, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret, as
+// sent in the X-Share-Signature header.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckURL validates a per-upload webhook URL.
+func CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("webhook-url must be an absolute http or https URL")
+	}
+	if u.User != nil {
+		return errors.New("webhook-url must not contain credentials")
+	}
+	return nil
+}